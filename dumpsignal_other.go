@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// There is no SIGUSR1 on other platforms
+var dumpSignals []os.Signal
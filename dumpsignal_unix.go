@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Sending SIGUSR1 writes the cache to a file, for debugging
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
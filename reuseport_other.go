@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// SO_REUSEPORT is only used on Linux
+const reusePortSupported = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
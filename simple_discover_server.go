@@ -1,27 +1,71 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/time/rate"
 )
 
 const (
-	maxHttpRequestSize      = 8 * 1024
+	defaultMaxRequestSize   = 8 * 1024
 	contentType             = "Content-Type"
 	respMimeApplicationJson = "application/json; charset=UTF-8"
+	respMimeTextPlain       = "text/plain; charset=UTF-8"
+	apiKeyHeader            = "X-Api-Key"
+	requestIdHeader         = "X-Request-Id"
+	maxRequestIdLength      = 128
+	expireSweepInterval     = 30 * time.Second
+	shutdownTimeout         = 15 * time.Second
+	maxWaitSeconds          = 300
+	maxImportSize           = 64 * 1024 * 1024
+	idempotencyWindow       = 5 * time.Minute
+	rateLimitIdleTime       = 5 * time.Minute
+	walCompactInterval      = 5 * time.Minute
+	maxWeight               = 1 << 20
+	maxTtlSeconds           = 10 * 365 * 24 * 60 * 60
+
+	// Non-standard, used by nginx for requests abandoned by the client
+	statusClientClosedRequest = 499
 )
 
 func fatal(msg string, err error) {
-	fmt.Printf("Fatal error %s: %v\n", msg, err)
+	slog.Error("Fatal error "+msg, "err", err)
 	os.Exit(1)
 }
 
@@ -32,287 +76,4371 @@ func fatal(msg string, err error) {
 type cache struct {
 	lock sync.RWMutex
 	m    map[string]*cacheEntry1
+	gen  uint64 // incremented on every change
+
+	// Closed and removed when the key changes, or removed when the last
+	// waiter gives up
+	waitLock sync.Mutex
+	waiters  map[string]*cacheWaiter
+
+	// Limits, zero means unlimited
+	maxSubsPerKey int
+	maxKeys       int
+
+	// Match keys ignoring case, the map is keyed by the lowercase key while
+	// cacheEntry1 keeps the original
+	caseInsensitiveKeys bool
+
+	// Fraction of the ttl by which expiration is randomly extended, so that
+	// entries registered together don't all expire at once
+	ttlJitter float64
+
+	// Changes are appended here when not nil, always written under the
+	// write lock so the log order matches the order of changes
+	wal *writeAheadLog
 }
 
 type cacheEntry1 struct {
-	key string
-	l   []*cacheEntry2
+	key      string
+	l        []*cacheEntry2
+	modified uint64       // value of gen at the last change
+	changed  int64        // unix millis of the last change
+	accessed atomic.Int64 // unix nanos, updated by get under the read lock
+	cursor   int          // next index for round robin, under the write lock
 }
 
 type cacheEntry2 struct {
-	sub   string
-	value string
+	sub      string
+	value    string
+	encoding string        // declared by the client, empty for plain text
+	weight   int           // for weighted selection, zero means 1
+	updated  int64         // unix millis
+	version  uint64        // starts at 1, incremented on every update
+	ttl      time.Duration // zero means never expires
+	expires  time.Time     // zero means never
+}
+
+type cacheWaiter struct {
+	ch   chan struct{}
+	refs int // under waitLock
+}
+
+func (ce2 *cacheEntry2) isExpired(now time.Time) bool {
+	return !ce2.expires.IsZero() && !now.Before(ce2.expires)
+}
+
+// A copy of an entry as returned by cache reads
+type Entry struct {
+	Sub      string
+	Value    string
+	Encoding string
+	Weight   int   // zero means 1
+	Updated  int64 // unix millis
+	Version  uint64
+	TTL      time.Duration // zero means never expires
+	Expires  time.Time     // zero means never
+}
+
+func (ce2 *cacheEntry2) entry() Entry {
+	return Entry{
+		Sub:      ce2.sub,
+		Value:    ce2.value,
+		Encoding: ce2.encoding,
+		Weight:   ce2.weight,
+		Updated:  ce2.updated,
+		Version:  ce2.version,
+		TTL:      ce2.ttl,
+		Expires:  ce2.expires,
+	}
 }
 
 func newCache() *cache {
 	return &cache{
-		m: make(map[string]*cacheEntry1),
+		m:       make(map[string]*cacheEntry1),
+		waiters: make(map[string]*cacheWaiter),
 	}
 }
 
-func (c *cache) put(key, sub, value string) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+func (c *cache) mapKey(key string) string {
+	if c.caseInsensitiveKeys {
+		return strings.ToLower(key)
+	}
+	return key
+}
 
-	ce1, ok := c.m[key]
+// Returns a channel which is closed on the next change to the key, and a
+// function to call exactly once when done waiting, so keys which never change
+// don't keep their waiters forever
+func (c *cache) changes(key string) (<-chan struct{}, func()) {
+	mapKey := c.mapKey(key)
+
+	c.waitLock.Lock()
+	defer c.waitLock.Unlock()
+
+	cw, ok := c.waiters[mapKey]
 	if !ok {
-		ce1 = &cacheEntry1{
-			key: key,
-			l:   make([]*cacheEntry2, 0),
-		}
-		c.m[key] = ce1
+		cw = &cacheWaiter{ch: make(chan struct{})}
+		c.waiters[mapKey] = cw
 	}
+	cw.refs++
 
-	for _, ce2 := range ce1.l {
-		if ce2.sub == sub {
-			ce2.value = value
-			return
+	done := func() {
+		c.waitLock.Lock()
+		defer c.waitLock.Unlock()
+
+		cw.refs--
+		if cw.refs == 0 && c.waiters[mapKey] == cw {
+			delete(c.waiters, mapKey)
 		}
 	}
 
-	ce1.l = append(ce1.l, &cacheEntry2{
-		sub:   sub,
-		value: value,
-	})
+	return cw.ch, done
 }
 
-func (c *cache) get(key string) []cacheEntry2 {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+func (c *cache) changedLocked(key string) {
+	mapKey := c.mapKey(key)
 
-	l := make([]cacheEntry2, 0)
+	c.gen++
+	if ce1, ok := c.m[mapKey]; ok {
+		ce1.modified = c.gen
+		ce1.changed = time.Now().UnixMilli()
+	}
 
-	ce1, ok := c.m[key]
-	if ok {
-		for _, ce2 := range ce1.l {
-			l = append(l, cacheEntry2{
-				sub:   ce2.sub,
-				value: ce2.value,
-			})
-		}
+	c.waitLock.Lock()
+	defer c.waitLock.Unlock()
+
+	if cw, ok := c.waiters[mapKey]; ok {
+		close(cw.ch)
+		delete(c.waiters, mapKey)
 	}
+}
 
-	return l
+func (c *cache) changedAllLocked() {
+	c.gen++
+
+	c.waitLock.Lock()
+	defer c.waitLock.Unlock()
+
+	for _, cw := range c.waiters {
+		close(cw.ch)
+	}
+	c.waiters = make(map[string]*cacheWaiter)
 }
 
-/**
- * HTTP utilities
- */
+type putResult struct {
+	version  uint64 // new version, or the current one on conflict
+	created  bool   // new entry as opposed to an update
+	conflict bool   // nothing was changed
+}
 
-func setNoCache(w http.ResponseWriter) {
-	w.Header().Set("Cache-Control", "max-age=0, no-cache, no-store")
-	w.Header().Set("Pragma", "no-cache")
+// Stores the value, if ifVersion is not nil the put only happens when it
+// matches the current version, which is zero for a missing entry.
+func (c *cache) put(key, sub, value, encoding string, weight int, ttl time.Duration, ifVersion *uint64) putResult {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ifVersion != nil {
+		var current uint64
+		if ce2 := c.findLocked(key, sub); ce2 != nil {
+			current = ce2.version
+		}
+		if current != *ifVersion {
+			return putResult{version: current, conflict: true}
+		}
+	}
+
+	return c.putLocked(key, sub, value, encoding, weight, ttl)
 }
 
-func readHttpRequest(r *http.Request, rq interface{}) (int, string) {
-	var err error
+var (
+	errNotJsonObject = errors.New("existing value is not a JSON object")
+	errValueTooLarge = errors.New("merged value is too large")
+	errNotInteger    = errors.New("existing value is not an integer")
+	errOverflow      = errors.New("integer overflow")
+)
 
-	defer func() { _ = r.Body.Close() }()
+// Shallow merges the patch into the existing value, which must be a JSON
+// object, a missing entry is treated as an empty object. The ttl, encoding and
+// weight of an existing entry are kept
+func (c *cache) putMerge(key, sub string, patch map[string]json.RawMessage, maxValueSize int) (putResult, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	requestData, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHttpRequestSize))
-	if err != nil {
-		return http.StatusBadRequest, "Error reading request"
+	object := make(map[string]json.RawMessage)
+	var encoding string
+	var weight int
+	var ttl time.Duration
+
+	if ce2 := c.findLocked(key, sub); ce2 != nil {
+		if err := json.Unmarshal([]byte(ce2.value), &object); err != nil || object == nil {
+			return putResult{}, errNotJsonObject
+		}
+		encoding = ce2.encoding
+		weight = ce2.weight
+		ttl = ce2.ttl
 	}
 
-	fmt.Printf("Request %s\n%s\n", r.URL, string(requestData))
+	for name, value := range patch {
+		object[name] = value
+	}
 
-	err = json.Unmarshal(requestData, &rq)
+	data, err := json.Marshal(object)
 	if err != nil {
-		return http.StatusBadRequest, fmt.Sprintf("Error parsing request: %s", err)
+		return putResult{}, err
+	}
+	if maxValueSize > 0 && len(data) > maxValueSize {
+		return putResult{}, errValueTooLarge
 	}
 
-	return http.StatusOK, ""
+	return c.putLocked(key, sub, string(data), encoding, weight, ttl), nil
 }
 
-func sendJsonResponse(w http.ResponseWriter, rs interface{}) {
-	w.Header().Set(contentType, respMimeApplicationJson)
+// Adds delta to an integer value, a missing value counts as zero
+func (c *cache) increment(key, sub string, delta int64) (int64, putResult, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	w.WriteHeader(http.StatusOK)
+	var current int64
+	var encoding string
+	var weight int
+	var ttl time.Duration
 
-	encoder := json.NewEncoder(w)
-	err := encoder.Encode(&rs)
+	if ce2 := c.findLocked(key, sub); ce2 != nil {
+		var err error
+		if current, err = strconv.ParseInt(strings.TrimSpace(ce2.value), 10, 64); err != nil {
+			return 0, putResult{}, errNotInteger
+		}
+		encoding = ce2.encoding
+		weight = ce2.weight
+		ttl = ce2.ttl
+	}
 
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(err.Error()))
+	value := current + delta
+	if (delta > 0 && value < current) || (delta < 0 && value > current) {
+		return 0, putResult{}, errOverflow
 	}
+
+	return value, c.putLocked(key, sub, strconv.FormatInt(value, 10), encoding, weight, ttl), nil
 }
 
-/**
- * Cache instance
- */
+func (c *cache) compareAndSwap(key, sub, expected, value, encoding string, weight int, ttl time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-var gCache = newCache()
+	current := ""
+	if ce2 := c.findLocked(key, sub); ce2 != nil {
+		current = ce2.value
+	}
 
-/**
- * HTTP put
- */
+	if current != expected {
+		return false
+	}
 
-type rqPut struct {
-	Key   string `json:"key"`
-	Sub   string `json:"sub"`
-	Value string `json:"value"`
+	c.putLocked(key, sub, value, encoding, weight, ttl)
+	return true
 }
 
-type rsPut struct {
-}
+// Returns the current version of an entry, zero if it doesn't exist
+func (c *cache) version(key, sub string) uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-func httpPut(w http.ResponseWriter, r *http.Request) {
-	var rq rqPut
+	if ce2 := c.findLocked(key, sub); ce2 != nil {
+		return ce2.version
+	}
+	return 0
+}
 
-	setNoCache(w)
+func (c *cache) findLocked(key, sub string) *cacheEntry2 {
+	ce1, ok := c.m[c.mapKey(key)]
+	if !ok {
+		return nil
+	}
 
-	status, message := readHttpRequest(r, &rq)
-	if status != http.StatusOK {
-		w.WriteHeader(status)
-		_, _ = w.Write([]byte(message))
-		return
+	for _, ce2 := range ce1.l {
+		if ce2.sub == sub {
+			if ce2.isExpired(time.Now()) {
+				return nil
+			}
+			return ce2
+		}
 	}
 
-	gCache.put(rq.Key, rq.Sub, rq.Value)
+	return nil
+}
 
-	rs := rsPut{}
-	sendJsonResponse(w, &rs)
+func (c *cache) jitteredTtl(ttl time.Duration) time.Duration {
+	if c.ttlJitter <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Float64()*c.ttlJitter*float64(ttl))
 }
 
-/**
- * HTTP get
- */
+func (c *cache) putLocked(key, sub, value, encoding string, weight int, ttl time.Duration) putResult {
+	now := time.Now()
+	updated := now.UnixMilli()
 
-type rqGet struct {
-	Key string `json:"key"`
-}
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(c.jitteredTtl(ttl))
+	}
 
-type rsGetValue struct {
-	Sub   string `json:"sub"`
-	Value string `json:"value"`
-}
+	ce1, ok := c.m[c.mapKey(key)]
+	if !ok {
+		if c.maxKeys > 0 && len(c.m) >= c.maxKeys {
+			c.evictLeastRecentlyUsed()
+		}
 
-type rsGet struct {
-	ValueList []rsGetValue `json:"value_list"`
-}
+		ce1 = &cacheEntry1{
+			key: key,
+			l:   make([]*cacheEntry2, 0),
+		}
+		c.m[c.mapKey(key)] = ce1
+	}
+	ce1.accessed.Store(now.UnixNano())
+	c.changedLocked(key)
 
-func httpGet(w http.ResponseWriter, r *http.Request) {
-	var rq rqGet
+	for _, ce2 := range ce1.l {
+		if ce2.sub == sub {
+			if ce2.isExpired(now) {
+				ce2.version = 0
+			}
+			ce2.value = value
+			ce2.encoding = encoding
+			ce2.weight = weight
+			ce2.updated = updated
+			ce2.version++
+			ce2.ttl = ttl
+			ce2.expires = expires
+			c.walPutLocked(ce1.key, ce2)
+			return putResult{version: ce2.version, created: ce2.version == 1}
+		}
+	}
 
-	setNoCache(w)
+	c.makeRoomForSubLocked(ce1)
 
-	status, message := readHttpRequest(r, &rq)
-	if status != http.StatusOK {
-		w.WriteHeader(status)
-		_, _ = w.Write([]byte(message))
+	ce2 := &cacheEntry2{
+		sub:      sub,
+		value:    value,
+		encoding: encoding,
+		weight:   weight,
+		updated:  updated,
+		version:  1,
+		ttl:      ttl,
+		expires:  expires,
+	}
+	ce1.l = append(ce1.l, ce2)
+	c.walPutLocked(ce1.key, ce2)
+
+	return putResult{version: 1, created: true}
+}
+
+// Evicts the oldest subs so one more fits, the list is in insertion order
+func (c *cache) makeRoomForSubLocked(ce1 *cacheEntry1) {
+	if c.maxSubsPerKey <= 0 || len(ce1.l) < c.maxSubsPerKey {
 		return
 	}
 
-	valueList := make([]rsGetValue, 0)
-	for _, item := range gCache.get(rq.Key) {
-		valueList = append(valueList, rsGetValue{
-			Sub:   item.sub,
-			Value: item.value,
-		})
+	evict := len(ce1.l) - c.maxSubsPerKey + 1
+	for i := 0; i < evict; i++ {
+		c.walLocked(&walRecord{Op: walOpDelete, Key: ce1.key, Sub: ce1.l[i].sub})
+		ce1.l[i] = nil
 	}
+	ce1.l = ce1.l[evict:]
+}
 
-	rs := rsGet{ValueList: valueList}
-	sendJsonResponse(w, &rs)
+// Returns copies of the live entries, never pointers into the map, so the
+// caller can use them without holding the lock
+func (c *cache) get(key string) []Entry {
+	l, _ := c.getWithVersion(key)
+	return l
 }
 
-/**
- * HTTP loop
- */
+// Also returns the key version, which changes on every modification of the
+// key and is zero when the key doesn't exist
+func (c *cache) getWithVersion(key string) ([]Entry, uint64) {
+	l, version, _ := c.getWithModified(key)
+	return l, version
+}
 
-func httpLoop(ip net.IP, port int) {
-	address := fmt.Sprintf("%s:%d", ip, port)
-	err := http.ListenAndServe(address, nil)
-	if err != nil {
-		fatal("cannot listen on http", err)
+// Also returns the time of the last modification of the key, which includes
+// deletes and expirations, or zero time when the key doesn't exist
+func (c *cache) getWithModified(key string) ([]Entry, uint64, time.Time) {
+	l, version, modified, expired := c.getWithModifiedOnce(key)
+	if expired {
+		// Expire now rather than at the next sweep, so the version and the
+		// modification time change and waiters wake up
+		c.expireKey(key)
+		l, version, modified, _ = c.getWithModifiedOnce(key)
 	}
+	return l, version, modified
 }
 
-/**
- * Flags
- */
+func (c *cache) getWithModifiedOnce(key string) ([]Entry, uint64, time.Time, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-type Flags struct {
-	listenInterface string
-	listenAddress   string
-	listenPort      int
+	l := make([]Entry, 0)
+	now := time.Now()
+	version := uint64(0)
+	var modified time.Time
+	expired := false
+
+	ce1, ok := c.m[c.mapKey(key)]
+	if ok {
+		version = ce1.modified
+		modified = time.UnixMilli(ce1.changed)
+		ce1.accessed.Store(now.UnixNano())
+		for _, ce2 := range ce1.l {
+			if ce2.isExpired(now) {
+				expired = true
+				continue
+			}
+			l = append(l, ce2.entry())
+		}
+	}
+
+	return l, version, modified, expired
 }
 
-/**
- * Get address for an interface
- */
+// Returns the values of all keys starting with the prefix, keys without any
+// live values are omitted
+func (c *cache) getByKeyPrefix(prefix string) map[string][]Entry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-func findInterfaceAddress(ifaceName string) *net.IP {
-	ifaceList, err := net.Interfaces()
-	if err != nil {
-		fatal("cannot get local interface list", err)
-	}
-	for _, iface := range ifaceList {
-		if iface.Name == ifaceName {
-			addrList, err := iface.Addrs()
-			if err != nil {
-				fatal("cannot get address list", err)
-			}
+	m := make(map[string][]Entry)
+	now := time.Now()
+	mappedPrefix := c.mapKey(prefix)
 
-			for _, addr := range addrList {
-				switch v := addr.(type) {
-				case *net.IPNet:
-					fmt.Printf("%v: %s\n", iface.Name, v)
-					return &v.IP
+	for mappedKey, ce1 := range c.m {
+		if !strings.HasPrefix(mappedKey, mappedPrefix) || keyNamespace(mappedKey) != keyNamespace(mappedPrefix) {
+			continue
+		}
 
-					//case *net.IPNet:
-					//	fmt.Printf("%v : %s [%v/%v]\n", i.Name, v, v.IP, v.Mask)
-				}
+		l := make([]Entry, 0, len(ce1.l))
+		for _, ce2 := range ce1.l {
+			if ce2.isExpired(now) {
+				continue
 			}
+			l = append(l, ce2.entry())
+		}
+		if len(l) > 0 {
+			ce1.accessed.Store(now.UnixNano())
+			m[ce1.key] = l
 		}
 	}
 
-	return nil
+	return m
 }
 
-/**
- * Main
- */
+// Returns the number of keys starting with the prefix and their live subs
+func (c *cache) countByKeyPrefix(prefix string) (int, int) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-func main() {
-	fmt.Printf("Hello this is simple discover server\n")
+	keyCount := 0
+	subCount := 0
+	now := time.Now()
+	mappedPrefix := c.mapKey(prefix)
 
-	// Parse flags
-	var flags Flags
+	for mappedKey, ce1 := range c.m {
+		if !strings.HasPrefix(mappedKey, mappedPrefix) || keyNamespace(mappedKey) != keyNamespace(mappedPrefix) {
+			continue
+		}
 
-	flag.StringVar(&flags.listenInterface, "i", "", "Listen interface")
-	flag.StringVar(&flags.listenAddress, "a", "", "Listen address")
-	flag.IntVar(&flags.listenPort, "p", 65001, "Listen port")
-	flag.Parse()
+		count := 0
+		for _, ce2 := range ce1.l {
+			if !ce2.isExpired(now) {
+				count++
+			}
+		}
+		if count > 0 {
+			keyCount++
+			subCount += count
+		}
+	}
 
-	if flags.listenPort <= 0 || flags.listenPort > 65535 {
-		fmt.Printf("Error: invalid listen port %d\n", flags.listenPort)
-		os.Exit(1)
+	return keyCount, subCount
+}
+
+// Returns the next value for the key in round robin order, the cursor is
+// wrapped around if the list has shrunk since the last call
+func (c *cache) getRoundRobin(key string) (Entry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ce1, ok := c.m[c.mapKey(key)]
+	if !ok {
+		return Entry{}, false
 	}
 
-	// Listen on HTTP
-	http.HandleFunc("/put", httpPut)
-	http.HandleFunc("/get", httpGet)
+	now := time.Now()
+	ce1.accessed.Store(now.UnixNano())
 
-	listenIP := net.IPv4(0, 0, 0, 0)
-	if flags.listenInterface != "" {
-		// On a specific interface
-		findIP := findInterfaceAddress(flags.listenInterface)
-		if findIP == nil {
-			fatal("cannot find interface address", errors.New(flags.listenAddress))
+	l := make([]*cacheEntry2, 0, len(ce1.l))
+	for _, ce2 := range ce1.l {
+		if !ce2.isExpired(now) {
+			l = append(l, ce2)
 		}
-		listenIP = *findIP
-	} else if flags.listenAddress != "" {
-		// On a specific address
-		listenIP = net.ParseIP(flags.listenAddress)
 	}
-	listenPort := flags.listenPort
+	if len(l) == 0 {
+		return Entry{}, false
+	}
 
-	go httpLoop(listenIP, listenPort)
+	index := ce1.cursor % len(l)
+	ce1.cursor = index + 1
 
-	// Just wait
-	for {
-		time.Sleep(time.Minute)
-		fmt.Printf("Still running...\n")
+	return l[index].entry(), true
+}
+
+// Removes the key which was least recently accessed by put or get, returns the
+// removed key or an empty string if the cache is empty. Must be called with the
+// write lock held.
+func (c *cache) evictLeastRecentlyUsed() string {
+	var lruKey string
+	var lruAccessed int64
+	found := false
+
+	for key, ce1 := range c.m {
+		accessed := ce1.accessed.Load()
+		if !found || accessed < lruAccessed || (accessed == lruAccessed && key < lruKey) {
+			lruKey = key
+			lruAccessed = accessed
+			found = true
+		}
+	}
+
+	if found {
+		c.walLocked(&walRecord{Op: walOpDeleteKey, Key: c.m[lruKey].key})
+		delete(c.m, lruKey)
+		c.changedLocked(lruKey)
+	}
+
+	return lruKey
+}
+
+// Everything about a key for diagnostics, including expired entries which
+// haven't been swept yet
+type cacheKeyDetail struct {
+	key      string
+	modified uint64
+	accessed int64 // unix nanos
+	l        []cacheEntry2
+}
+
+func (c *cache) inspect(key string) (cacheKeyDetail, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	ce1, ok := c.m[c.mapKey(key)]
+	if !ok {
+		return cacheKeyDetail{}, false
+	}
+
+	detail := cacheKeyDetail{
+		key:      ce1.key,
+		modified: ce1.modified,
+		accessed: ce1.accessed.Load(),
+		l:        make([]cacheEntry2, 0, len(ce1.l)),
+	}
+	for _, ce2 := range ce1.l {
+		detail.l = append(detail.l, *ce2)
 	}
+
+	return detail, true
+}
+
+type cacheKeyInfo struct {
+	key   string
+	count int
+}
+
+func (c *cache) keys() []cacheKeyInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	l := make([]cacheKeyInfo, 0, len(c.m))
+	now := time.Now()
+
+	for _, ce1 := range c.m {
+		count := 0
+		for _, ce2 := range ce1.l {
+			if !ce2.isExpired(now) {
+				count++
+			}
+		}
+		if count > 0 {
+			l = append(l, cacheKeyInfo{
+				key:   ce1.key,
+				count: count,
+			})
+		}
+	}
+
+	return l
+}
+
+func (c *cache) stats() (int, int) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	keyCount := 0
+	subCount := 0
+	now := time.Now()
+
+	for _, ce1 := range c.m {
+		count := 0
+		for _, ce2 := range ce1.l {
+			if !ce2.isExpired(now) {
+				count++
+			}
+		}
+		if count > 0 {
+			keyCount++
+			subCount += count
+		}
+	}
+
+	return keyCount, subCount
+}
+
+// Extends the expiration of an entry by its ttl, returns false if there is no
+// such entry or it has already expired
+func (c *cache) heartbeat(key, sub string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ce2 := c.findLocked(key, sub)
+	if ce2 == nil {
+		return false
+	}
+
+	if ce2.ttl > 0 {
+		ce2.expires = time.Now().Add(c.jitteredTtl(ce2.ttl))
+		c.gen++
+		c.walPutLocked(key, ce2)
+	}
+
+	return true
+}
+
+func (c *cache) delete(key, sub string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.deleteLocked(key, sub)
+}
+
+func (c *cache) deleteLocked(key, sub string) int {
+	ce1, ok := c.m[c.mapKey(key)]
+	if !ok {
+		return 0
+	}
+
+	removed := 0
+	for i, ce2 := range ce1.l {
+		if ce2.sub == sub {
+			ce1.l = append(ce1.l[:i], ce1.l[i+1:]...)
+			removed++
+			break
+		}
+	}
+
+	if len(ce1.l) == 0 {
+		delete(c.m, c.mapKey(key))
+	}
+
+	if removed > 0 {
+		c.changedLocked(key)
+		c.walLocked(&walRecord{Op: walOpDelete, Key: key, Sub: sub})
+	}
+
+	return removed
+}
+
+// Removes the sub from all keys starting with the prefix, returns the number
+// of entries removed
+func (c *cache) deleteSub(keyPrefix, sub string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := 0
+	mappedPrefix := c.mapKey(keyPrefix)
+
+	for mappedKey, ce1 := range c.m {
+		if !strings.HasPrefix(mappedKey, mappedPrefix) || keyNamespace(mappedKey) != keyNamespace(mappedPrefix) {
+			continue
+		}
+
+		for i, ce2 := range ce1.l {
+			if ce2.sub == sub {
+				ce1.l = append(ce1.l[:i], ce1.l[i+1:]...)
+				removed++
+				c.changedLocked(ce1.key)
+				c.walLocked(&walRecord{Op: walOpDelete, Key: ce1.key, Sub: sub})
+				break
+			}
+		}
+
+		if len(ce1.l) == 0 {
+			delete(c.m, mappedKey)
+		}
+	}
+
+	return removed
+}
+
+// Removes the key with all its subs, returns the number of live subs removed
+func (c *cache) deleteKey(key string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ce1, ok := c.m[c.mapKey(key)]
+	if !ok {
+		return 0
+	}
+
+	removed := 0
+	now := time.Now()
+	for _, ce2 := range ce1.l {
+		if !ce2.isExpired(now) {
+			removed++
+		}
+	}
+
+	delete(c.m, c.mapKey(key))
+	c.changedLocked(key)
+	c.walLocked(&walRecord{Op: walOpDeleteKey, Key: key})
+
+	return removed
+}
+
+func (c *cache) clear() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := len(c.m)
+	c.m = make(map[string]*cacheEntry1)
+	c.changedAllLocked()
+	c.walLocked(&walRecord{Op: walOpClear})
+
+	return removed
+}
+
+func (c *cache) expire() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := 0
+	now := time.Now()
+
+	for mapKey, ce1 := range c.m {
+		removed += c.expireLocked(mapKey, ce1, now)
+	}
+
+	return removed
+}
+
+// Same as expire for a single key, so reads don't have to wait for the sweep
+func (c *cache) expireKey(key string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	mapKey := c.mapKey(key)
+	ce1, ok := c.m[mapKey]
+	if !ok {
+		return 0
+	}
+
+	return c.expireLocked(mapKey, ce1, time.Now())
+}
+
+func (c *cache) expireLocked(mapKey string, ce1 *cacheEntry1, now time.Time) int {
+	l := ce1.l[:0]
+	for _, ce2 := range ce1.l {
+		if !ce2.isExpired(now) {
+			l = append(l, ce2)
+		}
+	}
+	for i := len(l); i < len(ce1.l); i++ {
+		ce1.l[i] = nil
+	}
+	if len(l) == len(ce1.l) {
+		return 0
+	}
+
+	removed := len(ce1.l) - len(l)
+	ce1.l = l
+
+	if len(ce1.l) == 0 {
+		delete(c.m, mapKey)
+	}
+	c.changedLocked(mapKey)
+
+	return removed
+}
+
+// Returns the earliest expiration among the key's entries, zero if none
+// of them expire
+func (c *cache) nextExpiry(key string) time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var next time.Time
+	if ce1, ok := c.m[c.mapKey(key)]; ok {
+		for _, ce2 := range ce1.l {
+			if !ce2.expires.IsZero() && (next.IsZero() || ce2.expires.Before(next)) {
+				next = ce2.expires
+			}
+		}
+	}
+	return next
+}
+
+func (c *cache) generation() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.gen
+}
+
+/**
+ * Persistence
+ */
+
+type persistEntry struct {
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+	Sub       string `json:"sub"`
+	Value     string `json:"value"`
+	Encoding  string `json:"encoding,omitempty"`
+	Weight    int    `json:"weight,omitempty"`
+	Updated   int64  `json:"updated"`           // unix millis
+	Version   uint64 `json:"version"`           // zero in files saved by older versions
+	Ttl       int64  `json:"ttl,omitempty"`     // millis, zero means never expires
+	Expires   int64  `json:"expires,omitempty"` // unix millis, zero means never
+}
+
+type persistData struct {
+	EntryList []persistEntry `json:"entry_list"`
+}
+
+func makePersistEntry(key string, ce2 *cacheEntry2) persistEntry {
+	pe := persistEntry{
+		Key:      key,
+		Sub:      ce2.sub,
+		Value:    ce2.value,
+		Encoding: ce2.encoding,
+		Weight:   ce2.weight,
+		Updated:  ce2.updated,
+		Version:  ce2.version,
+	}
+	if namespace, key, found := strings.Cut(key, namespaceSeparator); found {
+		pe.Namespace = namespace
+		pe.Key = key
+	}
+	if !ce2.expires.IsZero() {
+		pe.Ttl = ce2.ttl.Milliseconds()
+		pe.Expires = ce2.expires.UnixMilli()
+	}
+	return pe
+}
+
+// The key in the cache, with the namespace prepended
+func (pe *persistEntry) cacheKey() string {
+	if pe.Namespace == "" {
+		return pe.Key
+	}
+	return pe.Namespace + namespaceSeparator + pe.Key
+}
+
+func (c *cache) snapshot() ([]persistEntry, uint64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.snapshotLocked()
+}
+
+// Also rotates the write ahead log, the snapshot contains everything in the
+// rotated log
+func (c *cache) snapshotRotatingWal() ([]persistEntry, uint64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.wal != nil {
+		if err := c.wal.rotate(); err != nil {
+			slog.Error("Cannot rotate write ahead log", "file", c.wal.fileName, "err", err)
+		}
+	}
+
+	return c.snapshotLocked()
+}
+
+func (c *cache) snapshotLocked() ([]persistEntry, uint64) {
+	l := make([]persistEntry, 0)
+	now := time.Now()
+
+	for _, ce1 := range c.m {
+		for _, ce2 := range ce1.l {
+			if ce2.isExpired(now) {
+				continue
+			}
+			l = append(l, makePersistEntry(ce1.key, ce2))
+		}
+	}
+
+	return l, c.gen
+}
+
+// Replaces the entire contents of the cache
+func (c *cache) restore(l []persistEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.m = make(map[string]*cacheEntry1)
+	c.changedAllLocked()
+	c.walLocked(&walRecord{Op: walOpClear})
+
+	c.mergeLocked(l)
+}
+
+// Adds to the contents of the cache, replacing existing subs
+func (c *cache) merge(l []persistEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.mergeLocked(l)
+}
+
+func (c *cache) mergeLocked(l []persistEntry) {
+	now := time.Now()
+
+	for _, pe := range l {
+		key := pe.cacheKey()
+		ce1, ok := c.m[c.mapKey(key)]
+		if !ok {
+			// Same limits as put
+			if c.maxKeys > 0 && len(c.m) >= c.maxKeys {
+				c.evictLeastRecentlyUsed()
+			}
+
+			ce1 = &cacheEntry1{
+				key: key,
+				l:   make([]*cacheEntry2, 0),
+			}
+			ce1.accessed.Store(now.UnixNano())
+			c.m[c.mapKey(key)] = ce1
+		}
+
+		ce2 := &cacheEntry2{
+			sub:      pe.Sub,
+			value:    pe.Value,
+			encoding: pe.Encoding,
+			weight:   pe.Weight,
+			updated:  pe.Updated,
+			version:  pe.Version,
+		}
+		if ce2.version == 0 {
+			ce2.version = 1
+		}
+		if pe.Expires != 0 {
+			ce2.ttl = time.Duration(pe.Ttl) * time.Millisecond
+			ce2.expires = time.UnixMilli(pe.Expires)
+		}
+
+		replaced := false
+		for i, old := range ce1.l {
+			if old.sub == pe.Sub {
+				ce1.l[i] = ce2
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.makeRoomForSubLocked(ce1)
+			ce1.l = append(ce1.l, ce2)
+		}
+
+		c.changedLocked(key)
+		c.walPutLocked(ce1.key, ce2)
+	}
+}
+
+func saveCache(c *cache, fileName string) (uint64, error) {
+	entryList, gen := c.snapshotRotatingWal()
+
+	data, err := json.Marshal(&persistData{EntryList: entryList})
+	if err != nil {
+		return 0, err
+	}
+
+	// Write to a temp file and rename so a crash never leaves a partial file
+	f, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	tempName := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempName, fileName)
+	}
+	if err != nil {
+		_ = os.Remove(tempName)
+		return 0, err
+	}
+
+	if c.wal != nil {
+		c.wal.removeRotated()
+	}
+
+	return gen, nil
+}
+
+// Writes the cache in export format to a timestamped file, next to the persist
+// file if there is one
+func dumpCache(c *cache, persistFile string) (string, error) {
+	entryList, _ := c.snapshot()
+
+	data, err := json.Marshal(&persistData{EntryList: entryList})
+	if err != nil {
+		return "", err
+	}
+
+	dir := os.TempDir()
+	if persistFile != "" {
+		dir = filepath.Dir(persistFile)
+	}
+	fileName := filepath.Join(dir, "sds-dump-"+time.Now().Format("20060102-150405")+".json")
+
+	err = ioutil.WriteFile(fileName, data, 0o600)
+	if err != nil {
+		return "", err
+	}
+
+	return fileName, nil
+}
+
+func loadCache(c *cache, fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	var pd persistData
+	err = json.Unmarshal(data, &pd)
+	if err != nil {
+		return err
+	}
+
+	c.restore(pd.EntryList)
+	return nil
+}
+
+func snapshotLoop(c *cache, fileName string, interval time.Duration) {
+	savedGen := c.generation()
+
+	for {
+		time.Sleep(interval)
+		if c.generation() == savedGen {
+			continue
+		}
+
+		gen, err := saveCache(c, fileName)
+		if err != nil {
+			slog.Error("Cannot save cache snapshot", "file", fileName, "err", err)
+			continue
+		}
+		savedGen = gen
+	}
+}
+
+/**
+ * Write ahead log, every change is appended as a JSON line and replayed on
+ * startup on top of the persist file. Saving a snapshot rotates the log and
+ * removes the rotated log once the snapshot is safely written
+ */
+
+const (
+	walOpPut       = "put"
+	walOpDelete    = "delete"
+	walOpDeleteKey = "delete_key"
+	walOpClear     = "clear"
+)
+
+type walRecord struct {
+	Op    string        `json:"op"`
+	Entry *persistEntry `json:"entry,omitempty"` // for put
+	Key   string        `json:"key,omitempty"`
+	Sub   string        `json:"sub,omitempty"`
+}
+
+type writeAheadLog struct {
+	lock     sync.Mutex
+	fileName string
+	f        *os.File
+}
+
+func openWal(fileName string) (*writeAheadLog, error) {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{fileName: fileName, f: f}, nil
+}
+
+func (wal *writeAheadLog) rotatedFileName() string {
+	return wal.fileName + ".old"
+}
+
+func (wal *writeAheadLog) append(rec *walRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("Cannot encode write ahead log record", "err", err)
+		return
+	}
+	data = append(data, '\n')
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if _, err = wal.f.Write(data); err != nil {
+		slog.Error("Cannot write to write ahead log", "file", wal.fileName, "err", err)
+	}
+}
+
+// Moves the log aside and starts a new one. If the previously rotated log is
+// still there because saving a snapshot failed, keeps appending to the current
+// log instead, the next snapshot will cover both
+func (wal *writeAheadLog) rotate() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if _, err := os.Stat(wal.rotatedFileName()); err == nil {
+		return nil
+	}
+
+	// The open file follows the rename, so it can be restored on error
+	if err := os.Rename(wal.fileName, wal.rotatedFileName()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(wal.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		_ = os.Rename(wal.rotatedFileName(), wal.fileName)
+		return err
+	}
+
+	_ = wal.f.Close()
+	wal.f = f
+	return nil
+}
+
+func (wal *writeAheadLog) removeRotated() {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if err := os.Remove(wal.rotatedFileName()); err != nil && !os.IsNotExist(err) {
+		slog.Error("Cannot remove rotated write ahead log", "file", wal.rotatedFileName(), "err", err)
+	}
+}
+
+func (wal *writeAheadLog) close() {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	_ = wal.f.Close()
+}
+
+func (c *cache) walLocked(rec *walRecord) {
+	if c.wal != nil {
+		c.wal.append(rec)
+	}
+}
+
+func (c *cache) walPutLocked(key string, ce2 *cacheEntry2) {
+	if c.wal != nil {
+		pe := makePersistEntry(key, ce2)
+		c.wal.append(&walRecord{Op: walOpPut, Entry: &pe})
+	}
+}
+
+func (c *cache) applyWalRecord(rec *walRecord) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch rec.Op {
+	case walOpPut:
+		if rec.Entry != nil {
+			c.mergeLocked([]persistEntry{*rec.Entry})
+		}
+	case walOpDelete:
+		c.deleteLocked(rec.Key, rec.Sub)
+	case walOpDeleteKey:
+		delete(c.m, c.mapKey(rec.Key))
+		c.changedLocked(rec.Key)
+	case walOpClear:
+		c.m = make(map[string]*cacheEntry1)
+		c.changedAllLocked()
+	}
+}
+
+// Returns the number of records applied, a truncated last line from a crash
+// is reported as an error after applying everything before it
+func replayWal(c *cache, fileName string) (int, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportSize)
+
+	count := 0
+	for scanner.Scan() {
+		var rec walRecord
+		if err = json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return count, fmt.Errorf("record %d: %w", count+1, err)
+		}
+		c.applyWalRecord(&rec)
+		count++
+	}
+
+	return count, scanner.Err()
+}
+
+/**
+ * HTTP utilities
+ */
+
+func setNoCache(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "max-age=0, no-cache, no-store")
+	w.Header().Set("Pragma", "no-cache")
+}
+
+func getRemoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func checkHttpMethod(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, method := range allowed {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	sendJsonError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	return false
+}
+
+func readHttpRequest(r *http.Request, rq interface{}) (int, string) {
+	return readHttpRequestLimit(r, rq, gFlags.maxRequestSize)
+}
+
+func readHttpRequestLimit(r *http.Request, rq interface{}, maxRequestSize int) (int, string) {
+	var err error
+
+	defer func() { _ = r.Body.Close() }()
+
+	// Read one extra byte to detect bodies over the limit
+	requestData, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxRequestSize)+1))
+	if err != nil {
+		if r.Context().Err() != nil {
+			return statusClientClosedRequest, "Client closed request"
+		}
+		return http.StatusBadRequest, "Error reading request"
+	}
+	if len(requestData) > maxRequestSize {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Request is too large, maximum is %d bytes", maxRequestSize)
+	}
+
+	requestLogger(r).Debug("Request", "url", r.URL.String(), "body", string(requestData))
+
+	// Unknown fields are usually misspelled ones, which would otherwise be
+	// silently ignored
+	decoder := json.NewDecoder(bytes.NewReader(requestData))
+	if !gFlags.allowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	err = decoder.Decode(rq)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Error parsing request: %s", err)
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return http.StatusBadRequest, "Error parsing request: unexpected data after the JSON object"
+	}
+
+	return http.StatusOK, ""
+}
+
+// Returns true and sets the status if the client has gone away, to be checked
+// before doing work on behalf of the client
+func isClientGone(w http.ResponseWriter, r *http.Request) bool {
+	if r.Context().Err() == nil {
+		return false
+	}
+
+	w.WriteHeader(statusClientClosedRequest)
+	return true
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, item := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(item, ";")
+		if strings.TrimSpace(coding) == "gzip" {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// True if the client prefers text/plain over JSON, the default
+func acceptsPlainText(r *http.Request) bool {
+	for _, item := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(item, ";")
+		switch strings.TrimSpace(mediaType) {
+		case "text/plain":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+type rsError struct {
+	Error string `json:"error"`
+}
+
+func sendJsonError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set(contentType, respMimeApplicationJson)
+
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	if gFlags.pretty {
+		encoder.SetIndent("", "  ")
+	}
+	_ = encoder.Encode(&rsError{Error: message})
+}
+
+func sendJsonResponse(w http.ResponseWriter, r *http.Request, rs interface{}) {
+	sendJsonResponseStatus(w, r, http.StatusOK, rs)
+}
+
+// Writes the headers and returns the writer for the body, gzipped if the
+// client accepts it, and a function to call when done writing
+func startJsonResponse(w http.ResponseWriter, r *http.Request, status int) (io.Writer, func()) {
+	w.Header().Set(contentType, respMimeApplicationJson)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	var out io.Writer = w
+	done := func() {}
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		out = gz
+		done = func() { _ = gz.Close() }
+	}
+
+	w.WriteHeader(status)
+
+	return out, done
+}
+
+func sendJsonResponseStatus(w http.ResponseWriter, r *http.Request, status int, rs interface{}) {
+	out, done := startJsonResponse(w, r, status)
+	defer done()
+
+	encoder := json.NewEncoder(out)
+	if gFlags.pretty {
+		encoder.SetIndent("", "  ")
+	}
+	err := encoder.Encode(&rs)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+	}
+}
+
+func withApiKey(apiKey string, h http.HandlerFunc) http.HandlerFunc {
+	if apiKey == "" {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get(apiKeyHeader)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(apiKey)) != 1 {
+			sendJsonError(w, http.StatusUnauthorized, "Invalid or missing API key")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func withAllowed(allowed bool, h http.HandlerFunc) http.HandlerFunc {
+	if allowed {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		sendJsonError(w, http.StatusForbidden, "This endpoint is disabled")
+	}
+}
+
+func withCors(origin string, h http.Handler) http.Handler {
+	if origin == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", requestIdHeader)
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			// Preflight
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+apiKeyHeader+", "+requestIdHeader)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+/**
+ * Per client rate limiting, a token bucket for each client address
+ */
+
+type rateLimitClient struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+type rateLimiter struct {
+	lock    sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*rateLimitClient
+}
+
+// Nil when rate limiting is disabled
+var gRateLimiter *rateLimiter
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   max(1, int(math.Ceil(perSecond))),
+		clients: make(map[string]*rateLimitClient),
+	}
+}
+
+// Returns true if the request is allowed, otherwise how long to wait
+func (rl *rateLimiter) allow(client string) (bool, time.Duration) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	item, ok := rl.clients[client]
+	if !ok {
+		item = &rateLimitClient{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[client] = item
+	}
+	item.seen = now
+
+	reservation := item.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+func (rl *rateLimiter) expireIdle() {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	for client, item := range rl.clients {
+		if now.Sub(item.seen) >= rateLimitIdleTime {
+			delete(rl.clients, client)
+		}
+	}
+}
+
+func withRateLimit(rl *rateLimiter, h http.Handler) http.Handler {
+	if rl == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, delay := rl.allow(getRemoteHost(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			sendJsonError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+/**
+ * Limit on requests being handled at the same time, including long polls and
+ * watches, requests over the limit are rejected rather than queued
+ */
+
+func withInflightLimit(limit int, h http.Handler) http.Handler {
+	if limit <= 0 {
+		return h
+	}
+
+	slots := make(chan struct{}, limit)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			h.ServeHTTP(w, r)
+		default:
+			sendJsonError(w, http.StatusServiceUnavailable, "Too many requests in progress")
+		}
+	})
+}
+
+/**
+ * Access log
+ */
+
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// For http.ResponseController
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func withAccessLog(enabled bool, h http.Handler) http.Handler {
+	if !enabled {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w}
+
+		h.ServeHTTP(sw, r)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestLogger(r).Info("Access",
+			"client", getRemoteHost(r),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"duration", time.Since(start))
+	})
+}
+
+/**
+ * Request id, taken from the request header or generated, returned in the
+ * response header and included in log lines for the request
+ */
+
+type requestIdContextKey struct{}
+
+func withRequestId(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+		if id == "" || len(id) > maxRequestIdLength {
+			id = generateKey()
+		}
+
+		w.Header().Set(requestIdHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdContextKey{}, id)))
+	})
+}
+
+func requestLogger(r *http.Request) *slog.Logger {
+	id, _ := r.Context().Value(requestIdContextKey{}).(string)
+	if id == "" {
+		return slog.Default()
+	}
+	return slog.Default().With("request_id", id)
+}
+
+/**
+ * Namespaces, keyed endpoints are also available as /ns/{namespace}/{endpoint}
+ * with the namespace prepended to the cache key. The separator is a NUL which
+ * clients have no reason to use, so namespaced keys can't collide with keys
+ * written over the plain endpoints
+ */
+
+type namespaceContextKey struct{}
+
+const namespaceSeparator = "\x00"
+
+var namespacedEndpoints = map[string]bool{
+	"put":          true,
+	"cas":          true,
+	"put-batch":    true,
+	"put-merge":    true,
+	"incr":         true,
+	"get":          true,
+	"get-one":      true,
+	"get-batch":    true,
+	"get-prefix":   true,
+	"count-prefix": true,
+	"heartbeat":    true,
+	"delete":       true,
+	"delete-key":   true,
+	"delete-sub":   true,
+	"watch":        true,
+}
+
+func withNamespace(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace := r.PathValue("namespace")
+		endpoint := r.PathValue("endpoint")
+		if !namespacedEndpoints[endpoint] {
+			sendJsonError(w, http.StatusNotFound, fmt.Sprintf("Unknown namespaced endpoint: %s", endpoint))
+			return
+		}
+		if strings.Contains(namespace, namespaceSeparator) {
+			sendJsonError(w, http.StatusBadRequest, "Namespace must not contain a NUL character")
+			return
+		}
+
+		// Dispatch to the regular endpoint
+		nr := r.Clone(context.WithValue(r.Context(), namespaceContextKey{}, namespace))
+		nr.URL.Path = "/" + endpoint
+		nr.URL.RawPath = ""
+		h.ServeHTTP(w, nr)
+	}
+}
+
+func namespacedKey(r *http.Request, key string) string {
+	namespace, _ := r.Context().Value(namespaceContextKey{}).(string)
+	if namespace == "" {
+		return key
+	}
+	return namespace + namespaceSeparator + key
+}
+
+// Returns the namespace of a cache key, empty for keys written without one
+func keyNamespace(key string) string {
+	namespace, _, found := strings.Cut(key, namespaceSeparator)
+	if !found {
+		return ""
+	}
+	return namespace
+}
+
+// Outside of a namespace a key with the separator would address a key in
+// a namespace, so it's rejected. Keys with a "/" are fine everywhere
+func checkNamespacedKey(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	if namespace, _ := r.Context().Value(namespaceContextKey{}).(string); namespace != "" {
+		return true
+	}
+
+	for _, key := range keys {
+		if strings.Contains(key, namespaceSeparator) {
+			sendJsonError(w, http.StatusBadRequest, "Key must not contain a NUL character outside of a namespace")
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Cache instance
+ */
+
+var gCache = newCache()
+
+var gStartTime = time.Now()
+
+// Closed on shutdown to end long polls and watches
+var gShutdownChan = make(chan struct{})
+
+/**
+ * Startup state, set once the server is fully initialized
+ */
+
+var gReady int32
+
+func isReady() bool {
+	return atomic.LoadInt32(&gReady) != 0
+}
+
+func setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&gReady, v)
+}
+
+// Set once saved state is loaded, until then data endpoints are rejected
+var gLoaded int32
+
+func isLoaded() bool {
+	return atomic.LoadInt32(&gLoaded) != 0
+}
+
+func setLoaded() {
+	atomic.StoreInt32(&gLoaded, 1)
+}
+
+func withLoaded(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isLoaded() {
+			sendJsonError(w, http.StatusServiceUnavailable, "Loading saved state")
+			return
+		}
+		h(w, r)
+	}
+}
+
+/**
+ * HTTP put
+ */
+
+type rqPut struct {
+	Key         string  `json:"key"`
+	Sub         string  `json:"sub"`
+	Value       string  `json:"value"`
+	Encoding    string  `json:"encoding"` // e.g. base64, the value is stored as is
+	Weight      int     `json:"weight"`   // for weighted get-one, zero means 1
+	TtlSeconds  int64   `json:"ttl_seconds"`
+	IfVersion   *uint64 `json:"if_version"`
+	GenerateKey bool    `json:"generate_key"`
+
+	// Repeated puts with the same idempotency key return the first response
+	IdempotencyKey string `json:"idempotency_key"`
+
+	// Only validate and return what the put would do
+	DryRun bool `json:"dry_run"`
+
+	// Only put if the entry doesn't exist, same as if_version zero
+	CreateOnly bool `json:"create_only"`
+}
+
+type rsPut struct {
+	Key     string `json:"key,omitempty"` // only when generated
+	Sub     string `json:"sub"`
+	Version uint64 `json:"version"`
+	Created bool   `json:"created"`
+	DryRun  bool   `json:"dry_run,omitempty"`
+}
+
+func generateKey() string {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		fatal("cannot generate random key", err)
+	}
+
+	// Version 4 UUID
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+type rsPutConflict struct {
+	Error   string `json:"error"`
+	Version uint64 `json:"version"`
+}
+
+func validatePut(rq *rqPut) (int, string) {
+	if strings.TrimSpace(rq.Key) == "" {
+		return http.StatusBadRequest, "Key must not be empty"
+	}
+	if strings.TrimSpace(rq.Sub) == "" {
+		return http.StatusBadRequest, "Sub must not be empty"
+	}
+	if gFlags.maxKeySize > 0 && len(rq.Key) > gFlags.maxKeySize {
+		return http.StatusBadRequest, fmt.Sprintf("Key is too long, maximum is %d bytes", gFlags.maxKeySize)
+	}
+	if gFlags.maxKeySize > 0 && len(rq.Sub) > gFlags.maxKeySize {
+		return http.StatusBadRequest, fmt.Sprintf("Sub is too long, maximum is %d bytes", gFlags.maxKeySize)
+	}
+	if gFlags.maxValueSize > 0 && len(rq.Value) > gFlags.maxValueSize {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Value is too large, maximum is %d bytes", gFlags.maxValueSize)
+	}
+	if rq.Weight < 0 || rq.Weight > maxWeight {
+		return http.StatusBadRequest, fmt.Sprintf("Weight must be between 0 and %d", maxWeight)
+	}
+	// Larger values would overflow when converted to a duration
+	if rq.TtlSeconds < 0 || rq.TtlSeconds > maxTtlSeconds {
+		return http.StatusBadRequest, fmt.Sprintf("Ttl must be between 0 and %d seconds", maxTtlSeconds)
+	}
+	if rq.CreateOnly {
+		if rq.IfVersion != nil && *rq.IfVersion != 0 {
+			return http.StatusBadRequest, "Create only conflicts with a non-zero if_version"
+		}
+		// Checked atomically by the cache
+		rq.IfVersion = new(uint64)
+	}
+
+	return http.StatusOK, ""
+}
+
+func httpPut(w http.ResponseWriter, r *http.Request) {
+	var rq rqPut
+
+	metricRequests.WithLabelValues("put").Inc()
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if rq.Sub == "" {
+		// Each host is identified by its address
+		rq.Sub = getRemoteHost(r)
+	}
+
+	generatedKey := ""
+	if rq.Key == "" && rq.GenerateKey {
+		generatedKey = generateKey()
+		rq.Key = generatedKey
+	}
+
+	status, message = validatePut(&rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.Key) {
+		return
+	}
+
+	if rq.DryRun {
+		current := gCache.version(namespacedKey(r, rq.Key), rq.Sub)
+		if rq.IfVersion != nil && current != *rq.IfVersion {
+			rs := rsPutConflict{Error: "Version mismatch", Version: current}
+			sendJsonResponseStatus(w, r, http.StatusConflict, &rs)
+			return
+		}
+
+		rs := rsPut{Key: generatedKey, Sub: rq.Sub, Version: current + 1, Created: current == 0, DryRun: true}
+		sendJsonResponse(w, r, &rs)
+		return
+	}
+
+	var idempotency *idempotencyEntry
+	if rq.IdempotencyKey != "" {
+		idempotencyKey := namespacedKey(r, rq.IdempotencyKey)
+		for idempotency == nil {
+			entry, reserved := gIdempotency.reserve(idempotencyKey)
+			if reserved {
+				idempotency = entry
+				break
+			}
+
+			// Wait for the request which has it reserved
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.status != 0 {
+				sendJsonResponseStatus(w, r, entry.status, entry.rs)
+				return
+			}
+			// Released without a response, try again
+		}
+		defer gIdempotency.release(idempotency)
+	}
+
+	if isClientGone(w, r) {
+		return
+	}
+
+	ttl := time.Duration(rq.TtlSeconds) * time.Second
+	result := gCache.put(namespacedKey(r, rq.Key), rq.Sub, rq.Value, rq.Encoding, rq.Weight, ttl, rq.IfVersion)
+	if result.conflict {
+		rs := rsPutConflict{Error: "Version mismatch", Version: result.version}
+		if rq.CreateOnly {
+			rs.Error = "Entry already exists"
+		}
+		if idempotency != nil {
+			gIdempotency.complete(idempotency, http.StatusConflict, &rs)
+		}
+		sendJsonResponseStatus(w, r, http.StatusConflict, &rs)
+		return
+	}
+
+	rs := rsPut{Key: generatedKey, Sub: rq.Sub, Version: result.version, Created: result.created}
+	if idempotency != nil {
+		gIdempotency.complete(idempotency, http.StatusOK, &rs)
+	}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * Recently seen put idempotency keys with their responses, a key is reserved
+ * before the put so concurrent retries wait for the first one instead of
+ * applying the put again
+ */
+
+type idempotencyEntry struct {
+	key    string
+	status int // zero until complete
+	rs     interface{}
+	seen   time.Time
+	done   chan struct{} // closed by complete or release
+}
+
+type idempotencyCache struct {
+	lock sync.Mutex
+	m    map[string]*idempotencyEntry
+}
+
+var gIdempotency = newIdempotencyCache()
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{m: make(map[string]*idempotencyEntry)}
+}
+
+// Returns the entry for the key and false if it's already reserved or
+// complete, otherwise reserves it and returns the new entry and true
+func (ic *idempotencyCache) reserve(key string) (*idempotencyEntry, bool) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	if entry, ok := ic.m[key]; ok && time.Since(entry.seen) < idempotencyWindow {
+		return entry, false
+	}
+
+	entry := &idempotencyEntry{key: key, seen: time.Now(), done: make(chan struct{})}
+	ic.m[key] = entry
+	return entry, true
+}
+
+func (ic *idempotencyCache) complete(entry *idempotencyEntry, status int, rs interface{}) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	entry.status = status
+	entry.rs = rs
+	entry.seen = time.Now()
+	close(entry.done)
+}
+
+// Drops a reservation which wasn't completed, e.g. the client went away, so
+// the next retry does the put
+func (ic *idempotencyCache) release(entry *idempotencyEntry) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	select {
+	case <-entry.done:
+		return
+	default:
+	}
+
+	if ic.m[entry.key] == entry {
+		delete(ic.m, entry.key)
+	}
+	close(entry.done)
+}
+
+func (ic *idempotencyCache) expire() {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	now := time.Now()
+	for key, entry := range ic.m {
+		if now.Sub(entry.seen) >= idempotencyWindow {
+			delete(ic.m, key)
+		}
+	}
+}
+
+/**
+ * HTTP put merge, updates fields of a JSON object value
+ */
+
+type rqPutMerge struct {
+	Key   string                     `json:"key"`
+	Sub   string                     `json:"sub"`
+	Patch map[string]json.RawMessage `json:"patch"`
+}
+
+func httpPutMerge(w http.ResponseWriter, r *http.Request) {
+	var rq rqPutMerge
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if rq.Sub == "" {
+		rq.Sub = getRemoteHost(r)
+	}
+
+	status, message = validatePut(&rqPut{Key: rq.Key, Sub: rq.Sub})
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if isClientGone(w, r) {
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.Key) {
+		return
+	}
+
+	result, err := gCache.putMerge(namespacedKey(r, rq.Key), rq.Sub, rq.Patch, gFlags.maxValueSize)
+	if errors.Is(err, errValueTooLarge) {
+		sendJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Value is too large, maximum is %d bytes", gFlags.maxValueSize))
+		return
+	}
+	if err != nil {
+		sendJsonError(w, http.StatusBadRequest, fmt.Sprintf("Cannot merge: %s", err))
+		return
+	}
+
+	rs := rsPut{Sub: rq.Sub, Version: result.version, Created: result.created}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP increment, for counters and sequence numbers
+ */
+
+type rqIncr struct {
+	Key   string `json:"key"`
+	Sub   string `json:"sub"`
+	Delta int64  `json:"delta"`
+}
+
+type rsIncr struct {
+	Sub     string `json:"sub"`
+	Value   int64  `json:"value"`
+	Version uint64 `json:"version"`
+	Created bool   `json:"created,omitempty"`
+}
+
+func httpIncr(w http.ResponseWriter, r *http.Request) {
+	var rq rqIncr
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if rq.Sub == "" {
+		rq.Sub = getRemoteHost(r)
+	}
+
+	status, message = validatePut(&rqPut{Key: rq.Key, Sub: rq.Sub})
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if isClientGone(w, r) {
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.Key) {
+		return
+	}
+
+	value, result, err := gCache.increment(namespacedKey(r, rq.Key), rq.Sub, rq.Delta)
+	if err != nil {
+		sendJsonError(w, http.StatusBadRequest, fmt.Sprintf("Cannot increment: %s", err))
+		return
+	}
+
+	rs := rsIncr{Sub: rq.Sub, Value: value, Version: result.version, Created: result.created}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP put batch
+ */
+
+type rqPutBatch struct {
+	Items []rqPutBatchItem `json:"items"`
+}
+
+// Same as rqPut without the fields which only make sense for a single put,
+// so they're rejected as unknown instead of being ignored
+type rqPutBatchItem struct {
+	Key        string  `json:"key"`
+	Sub        string  `json:"sub"`
+	Value      string  `json:"value"`
+	Encoding   string  `json:"encoding"`
+	Weight     int     `json:"weight"`
+	TtlSeconds int64   `json:"ttl_seconds"`
+	IfVersion  *uint64 `json:"if_version"`
+	CreateOnly bool    `json:"create_only"`
+}
+
+type rsPutBatch struct {
+	Count int `json:"count"`
+}
+
+func httpPutBatch(w http.ResponseWriter, r *http.Request) {
+	var rq rqPutBatch
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	remoteHost := getRemoteHost(r)
+	putList := make([]rqPut, 0, len(rq.Items))
+	for i, item := range rq.Items {
+		put := rqPut{
+			Key:        item.Key,
+			Sub:        item.Sub,
+			Value:      item.Value,
+			Encoding:   item.Encoding,
+			Weight:     item.Weight,
+			TtlSeconds: item.TtlSeconds,
+			IfVersion:  item.IfVersion,
+			CreateOnly: item.CreateOnly,
+		}
+		if put.Sub == "" {
+			put.Sub = remoteHost
+		}
+
+		status, message = validatePut(&put)
+		if status != http.StatusOK {
+			sendJsonError(w, status, fmt.Sprintf("Item %d: %s", i, message))
+			return
+		}
+		if !checkNamespacedKey(w, r, put.Key) {
+			return
+		}
+
+		putList = append(putList, put)
+	}
+
+	if isClientGone(w, r) {
+		return
+	}
+
+	count := 0
+	for _, item := range putList {
+		ttl := time.Duration(item.TtlSeconds) * time.Second
+		if result := gCache.put(namespacedKey(r, item.Key), item.Sub, item.Value, item.Encoding, item.Weight, ttl, item.IfVersion); !result.conflict {
+			count++
+		}
+	}
+
+	rs := rsPutBatch{Count: count}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP get
+ */
+
+type rqGet struct {
+	Key            string `json:"key"`
+	SubPrefix      string `json:"sub_prefix"`
+	ValueContains  string `json:"value_contains"`
+	MaxAgeSeconds  int64  `json:"max_age_seconds"`
+	WaitSeconds    int    `json:"wait_seconds"`
+	WaitKeyVersion uint64 `json:"wait_key_version"`
+	SubsOnly       bool   `json:"subs_only"`
+	Distinct       bool   `json:"distinct"` // only the first sub for each value
+	Sort           string `json:"sort"`     // sub, updated or value, default is insertion order
+}
+
+type rsGetValue struct {
+	Sub      string `json:"sub"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+	Updated  int64  `json:"updated"`
+	Version  uint64 `json:"version"`
+
+	// Only for entries with a ttl
+	TtlRemainingSeconds *float64 `json:"ttl_remaining_seconds,omitempty"`
+}
+
+// For subs_only
+type rsGetSubs struct {
+	SubList    []string `json:"sub_list"`
+	Count      int      `json:"count"`
+	KeyVersion uint64   `json:"key_version"`
+}
+
+type rsGet struct {
+	ValueList  []rsGetValue `json:"value_list"`
+	Count      int          `json:"count"`
+	KeyVersion uint64       `json:"key_version"`
+}
+
+func makeRsGetValue(item *Entry) rsGetValue {
+	rs := rsGetValue{
+		Sub:      item.Sub,
+		Value:    item.Value,
+		Encoding: item.Encoding,
+		Weight:   item.Weight,
+		Updated:  item.Updated,
+		Version:  item.Version,
+	}
+	if !item.Expires.IsZero() {
+		remaining := float64(max(time.Until(item.Expires).Milliseconds(), 0)) / 1000
+		rs.TtlRemainingSeconds = &remaining
+	}
+	return rs
+}
+
+func httpGet(w http.ResponseWriter, r *http.Request) {
+	var rq rqGet
+
+	metricRequests.WithLabelValues("get").Inc()
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet && r.ContentLength == 0 {
+		// Key in query string, e.g. from curl or a browser
+		query := r.URL.Query()
+		rq.Key = query.Get("key")
+		rq.SubPrefix = query.Get("sub_prefix")
+		rq.ValueContains = query.Get("value_contains")
+		rq.SubsOnly, _ = strconv.ParseBool(query.Get("subs_only"))
+		rq.Distinct, _ = strconv.ParseBool(query.Get("distinct"))
+		rq.Sort = query.Get("sort")
+		if maxAge := query.Get("max_age_seconds"); maxAge != "" {
+			var err error
+			if rq.MaxAgeSeconds, err = strconv.ParseInt(maxAge, 10, 64); err != nil {
+				sendJsonError(w, http.StatusBadRequest, "Invalid max age")
+				return
+			}
+		}
+		if waitSeconds := query.Get("wait_seconds"); waitSeconds != "" {
+			var err error
+			if rq.WaitSeconds, err = strconv.Atoi(waitSeconds); err != nil {
+				sendJsonError(w, http.StatusBadRequest, "Invalid wait seconds")
+				return
+			}
+		}
+		if waitKeyVersion := query.Get("wait_key_version"); waitKeyVersion != "" {
+			var err error
+			if rq.WaitKeyVersion, err = strconv.ParseUint(waitKeyVersion, 10, 64); err != nil {
+				sendJsonError(w, http.StatusBadRequest, "Invalid wait key version")
+				return
+			}
+		}
+	} else {
+		status, message := readHttpRequest(r, &rq)
+		if status != http.StatusOK {
+			sendJsonError(w, status, message)
+			return
+		}
+	}
+
+	switch rq.Sort {
+	case "", "sub", "updated", "value":
+	default:
+		sendJsonError(w, http.StatusBadRequest, fmt.Sprintf("Unknown sort: %s", rq.Sort))
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.Key) {
+		return
+	}
+
+	key := namespacedKey(r, rq.Key)
+	itemList, keyVersion, modified := gCache.getWithModified(key)
+
+	if rq.WaitSeconds > 0 {
+		// Long poll until the key changes
+		wait := time.Duration(min(rq.WaitSeconds, maxWaitSeconds)) * time.Second
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		rc := http.NewResponseController(w)
+		_ = rc.SetWriteDeadline(time.Now().Add(wait + time.Duration(gFlags.writeTimeout)*time.Second))
+
+		for waiting := true; waiting; {
+			changes, doneWaiting := gCache.changes(key)
+			itemList, keyVersion, modified = gCache.getWithModified(key)
+
+			if rq.WaitKeyVersion != 0 {
+				waiting = keyVersion == rq.WaitKeyVersion
+			} else {
+				waiting = len(itemList) == 0
+			}
+			if !waiting {
+				doneWaiting()
+				break
+			}
+
+			// Expiration is a change too, picked up by the next read
+			expiry := newExpiryTimer(key)
+
+			select {
+			case <-changes:
+			case <-expiry.C:
+			case <-timer.C:
+				waiting = false
+			case <-gShutdownChan:
+				waiting = false
+			case <-r.Context().Done():
+				expiry.Stop()
+				doneWaiting()
+				isClientGone(w, r)
+				return
+			}
+			expiry.Stop()
+			doneWaiting()
+		}
+	}
+
+	if !modified.IsZero() && len(itemList) > 0 && rq.MaxAgeSeconds <= 0 {
+		// Not modified since, at the one second resolution of HTTP dates, only
+		// used without If-None-Match which is precise (RFC 9110 13.2.2). With
+		// a max age entries drop out of the response as time passes without
+		// the key being modified, so there is no Last-Modified
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && r.Header.Get("If-None-Match") == "" && !modified.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if len(itemList) == 0 {
+		if value, ok := gDefaults[key]; ok {
+			itemList = []Entry{{Sub: defaultSub, Value: value, Updated: gStartTime.UnixMilli(), Version: 1}}
+		}
+	}
+
+	var minUpdated int64
+	if rq.MaxAgeSeconds > 0 {
+		minUpdated = time.Now().Add(-time.Duration(rq.MaxAgeSeconds) * time.Second).UnixMilli()
+	}
+
+	seenValues := make(map[string]bool)
+
+	valueList := make([]rsGetValue, 0)
+	for _, item := range itemList {
+		if item.Updated < minUpdated {
+			continue
+		}
+		if !strings.HasPrefix(item.Sub, rq.SubPrefix) {
+			continue
+		}
+		if !strings.Contains(item.Value, rq.ValueContains) {
+			continue
+		}
+		if rq.Distinct {
+			if seenValues[item.Value] {
+				continue
+			}
+			seenValues[item.Value] = true
+		}
+		valueList = append(valueList, makeRsGetValue(&item))
+	}
+
+	switch rq.Sort {
+	case "sub":
+		sort.SliceStable(valueList, func(i, j int) bool { return valueList[i].Sub < valueList[j].Sub })
+	case "updated":
+		sort.SliceStable(valueList, func(i, j int) bool { return valueList[i].Updated < valueList[j].Updated })
+	case "value":
+		sort.SliceStable(valueList, func(i, j int) bool { return valueList[i].Value < valueList[j].Value })
+	}
+
+	etag := makeGetETag(valueList, rq.SubsOnly, acceptsPlainText(r))
+	w.Header().Set("ETag", etag)
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if rq.SubsOnly {
+		subList := make([]string, 0, len(valueList))
+		for _, item := range valueList {
+			subList = append(subList, item.Sub)
+		}
+
+		if acceptsPlainText(r) {
+			w.Header().Set(contentType, respMimeTextPlain)
+			for _, sub := range subList {
+				_, _ = io.WriteString(w, sub+"\n")
+			}
+			return
+		}
+
+		rs := rsGetSubs{SubList: subList, Count: len(subList), KeyVersion: keyVersion}
+		sendJsonResponse(w, r, &rs)
+		return
+	}
+
+	if acceptsPlainText(r) {
+		// One value per line, for shell scripts
+		w.Header().Set(contentType, respMimeTextPlain)
+		for _, item := range valueList {
+			_, _ = io.WriteString(w, item.Value+"\n")
+		}
+		return
+	}
+
+	rs := rsGet{ValueList: valueList, Count: len(valueList), KeyVersion: keyVersion}
+	sendJsonResponse(w, r, &rs)
+}
+
+// The etag covers what's in the response except the remaining ttl, which
+// changes all the time, and differs between response formats
+func makeGetETag(valueList []rsGetValue, subsOnly, plainText bool) string {
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%t %t\n", subsOnly, plainText)
+	for _, item := range valueList {
+		_, _ = fmt.Fprintf(h, "%q %q %q %d %d %d\n",
+			item.Sub, item.Value, item.Encoding, item.Weight, item.Updated, item.Version)
+	}
+	return fmt.Sprintf("\"%016x\"", h.Sum64())
+}
+
+// If-None-Match can be a list of etags or *, and uses weak comparison
+func matchesETag(ifNoneMatch, etag string) bool {
+	for _, s := range strings.Split(ifNoneMatch, ",") {
+		s = strings.TrimPrefix(strings.TrimSpace(s), "W/")
+		if s == "*" || s == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * HTTP get one
+ */
+
+type rqGetOne struct {
+	Key      string `json:"key"`
+	Strategy string `json:"strategy"` // first (default), random, weighted or roundrobin
+}
+
+func httpGetOne(w http.ResponseWriter, r *http.Request) {
+	var rq rqGetOne
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.Key) {
+		return
+	}
+
+	if rq.Strategy == "roundrobin" {
+		item, ok := gCache.getRoundRobin(namespacedKey(r, rq.Key))
+		if !ok {
+			sendJsonError(w, http.StatusNotFound, "No values for key")
+			return
+		}
+
+		rs := makeRsGetValue(&item)
+		sendJsonResponse(w, r, &rs)
+		return
+	}
+
+	itemList := gCache.get(namespacedKey(r, rq.Key))
+	if len(itemList) == 0 {
+		sendJsonError(w, http.StatusNotFound, "No values for key")
+		return
+	}
+
+	var index int
+	switch rq.Strategy {
+	case "", "first":
+		index = 0
+	case "random":
+		index = rand.Intn(len(itemList))
+	case "weighted":
+		index = pickWeighted(itemList)
+	default:
+		sendJsonError(w, http.StatusBadRequest, fmt.Sprintf("Unknown strategy: %s", rq.Strategy))
+		return
+	}
+
+	rs := makeRsGetValue(&itemList[index])
+	sendJsonResponse(w, r, &rs)
+}
+
+// Returns an index with probability proportional to the entry's weight
+func pickWeighted(itemList []Entry) int {
+	total := 0
+	for _, item := range itemList {
+		total += effectiveWeight(item.Weight)
+	}
+
+	n := rand.Intn(total)
+	for i, item := range itemList {
+		n -= effectiveWeight(item.Weight)
+		if n < 0 {
+			return i
+		}
+	}
+	return len(itemList) - 1
+}
+
+// Clamped so the total can't overflow, also for entries which were loaded
+// from a persist file and never went through validatePut
+func effectiveWeight(weight int) int {
+	return min(max(weight, 1), maxWeight)
+}
+
+/**
+ * HTTP get batch
+ */
+
+type rqGetBatch struct {
+	Keys []string `json:"keys"`
+}
+
+type rsGetBatch struct {
+	ValueMap map[string][]rsGetValue `json:"value_map"`
+}
+
+func httpGetBatch(w http.ResponseWriter, r *http.Request) {
+	var rq rqGetBatch
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.Keys...) {
+		return
+	}
+
+	valueMap := make(map[string][]rsGetValue)
+	for _, key := range rq.Keys {
+		valueList := make([]rsGetValue, 0)
+		for _, item := range gCache.get(namespacedKey(r, key)) {
+			valueList = append(valueList, makeRsGetValue(&item))
+		}
+		valueMap[key] = valueList
+	}
+
+	rs := rsGetBatch{ValueMap: valueMap}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP get by key prefix
+ */
+
+type rqGetPrefix struct {
+	KeyPrefix string `json:"key_prefix"`
+}
+
+type rsGetPrefix struct {
+	ValueMap map[string][]rsGetValue `json:"value_map"`
+}
+
+func httpGetPrefix(w http.ResponseWriter, r *http.Request) {
+	var rq rqGetPrefix
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if rq.KeyPrefix == "" {
+		sendJsonError(w, http.StatusBadRequest, "Key prefix must not be empty")
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.KeyPrefix) {
+		return
+	}
+
+	// Keys are returned without the namespace
+	namespacePrefix := namespacedKey(r, "")
+
+	valueMap := make(map[string][]rsGetValue)
+	for key, list := range gCache.getByKeyPrefix(namespacedKey(r, rq.KeyPrefix)) {
+		valueList := make([]rsGetValue, 0, len(list))
+		for _, item := range list {
+			valueList = append(valueList, makeRsGetValue(&item))
+		}
+		valueMap[key[len(namespacePrefix):]] = valueList
+	}
+
+	rs := rsGetPrefix{ValueMap: valueMap}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP count by key prefix, an empty prefix counts everything
+ */
+
+type rsCountPrefix struct {
+	Keys int `json:"keys"`
+	Subs int `json:"subs"`
+}
+
+func httpCountPrefix(w http.ResponseWriter, r *http.Request) {
+	var rq rqGetPrefix
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.KeyPrefix) {
+		return
+	}
+
+	keyCount, subCount := gCache.countByKeyPrefix(namespacedKey(r, rq.KeyPrefix))
+
+	rs := rsCountPrefix{Keys: keyCount, Subs: subCount}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP compare and swap
+ */
+
+type rqCas struct {
+	Key        string `json:"key"`
+	Sub        string `json:"sub"`
+	Expected   string `json:"expected"`
+	Value      string `json:"value"`
+	Encoding   string `json:"encoding"`
+	Weight     int    `json:"weight"`
+	TtlSeconds int64  `json:"ttl_seconds"`
+}
+
+type rsCas struct {
+	Swapped bool `json:"swapped"`
+}
+
+func httpCas(w http.ResponseWriter, r *http.Request) {
+	var rq rqCas
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	status, message = validatePut(&rqPut{Key: rq.Key, Sub: rq.Sub, Value: rq.Value, Weight: rq.Weight, TtlSeconds: rq.TtlSeconds})
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if isClientGone(w, r) {
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.Key) {
+		return
+	}
+
+	ttl := time.Duration(rq.TtlSeconds) * time.Second
+	swapped := gCache.compareAndSwap(namespacedKey(r, rq.Key), rq.Sub, rq.Expected, rq.Value, rq.Encoding, rq.Weight, ttl)
+
+	rs := rsCas{Swapped: swapped}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP watch, streams changes to a key as server-sent events
+ */
+
+func httpWatch(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		sendJsonError(w, http.StatusBadRequest, "Key must not be empty")
+		return
+	}
+	if !checkNamespacedKey(w, r, key) {
+		return
+	}
+
+	key = namespacedKey(r, key)
+
+	rc := http.NewResponseController(w)
+
+	// The connection stays open until the client goes away
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set(contentType, "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+
+	sent := false
+	var sentVersion uint64
+
+	for {
+		changes, doneWaiting := gCache.changes(key)
+		itemList, keyVersion := gCache.getWithVersion(key)
+
+		// Expiring on read wakes this watch too, with nothing new to send
+		if !sent || keyVersion != sentVersion {
+			valueList := make([]rsGetValue, 0)
+			for _, item := range itemList {
+				valueList = append(valueList, makeRsGetValue(&item))
+			}
+
+			data, err := json.Marshal(&rsGet{ValueList: valueList, Count: len(valueList), KeyVersion: keyVersion})
+			if err != nil {
+				doneWaiting()
+				return
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				doneWaiting()
+				return
+			}
+
+			sent = true
+			sentVersion = keyVersion
+		}
+
+		expiry := newExpiryTimer(key)
+
+		select {
+		case <-changes:
+		case <-expiry.C:
+		case <-gShutdownChan:
+			expiry.Stop()
+			doneWaiting()
+			return
+		case <-r.Context().Done():
+			expiry.Stop()
+			doneWaiting()
+			return
+		}
+		expiry.Stop()
+		doneWaiting()
+	}
+}
+
+// Fires when the next entry of the key expires, never if none do
+func newExpiryTimer(key string) *time.Timer {
+	next := gCache.nextExpiry(key)
+	if next.IsZero() {
+		t := time.NewTimer(time.Hour)
+		t.Stop()
+		return t
+	}
+	return time.NewTimer(time.Until(next))
+}
+
+/**
+ * HTTP heartbeat
+ */
+
+type rqHeartbeat struct {
+	Key string `json:"key"`
+	Sub string `json:"sub"`
+}
+
+type rsHeartbeat struct {
+}
+
+func httpHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var rq rqHeartbeat
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if rq.Sub == "" {
+		// Same as put
+		rq.Sub = getRemoteHost(r)
+	}
+
+	if !checkNamespacedKey(w, r, rq.Key) {
+		return
+	}
+
+	if !gCache.heartbeat(namespacedKey(r, rq.Key), rq.Sub) {
+		sendJsonError(w, http.StatusNotFound, "No such entry")
+		return
+	}
+
+	rs := rsHeartbeat{}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP delete
+ */
+
+type rqDelete struct {
+	Key string `json:"key"`
+	Sub string `json:"sub"`
+}
+
+type rsDelete struct {
+	Removed int `json:"removed"`
+}
+
+func httpDelete(w http.ResponseWriter, r *http.Request) {
+	var rq rqDelete
+
+	metricRequests.WithLabelValues("delete").Inc()
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if isClientGone(w, r) {
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.Key) {
+		return
+	}
+
+	removed := gCache.delete(namespacedKey(r, rq.Key), rq.Sub)
+
+	rs := rsDelete{Removed: removed}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP delete key, removes all subs under the key
+ */
+
+type rqDeleteKey struct {
+	Key string `json:"key"`
+}
+
+func httpDeleteKey(w http.ResponseWriter, r *http.Request) {
+	var rq rqDeleteKey
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if rq.Key == "" {
+		sendJsonError(w, http.StatusBadRequest, "Key must not be empty")
+		return
+	}
+
+	if isClientGone(w, r) {
+		return
+	}
+
+	if !checkNamespacedKey(w, r, rq.Key) {
+		return
+	}
+
+	removed := gCache.deleteKey(namespacedKey(r, rq.Key))
+
+	rs := rsDelete{Removed: removed}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP delete sub, removes the sub from all keys
+ */
+
+type rqDeleteSub struct {
+	Sub string `json:"sub"`
+}
+
+func httpDeleteSub(w http.ResponseWriter, r *http.Request) {
+	var rq rqDeleteSub
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	status, message := readHttpRequest(r, &rq)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	if rq.Sub == "" {
+		sendJsonError(w, http.StatusBadRequest, "Sub must not be empty")
+		return
+	}
+
+	if isClientGone(w, r) {
+		return
+	}
+
+	// Limited to the namespace if there is one
+	removed := gCache.deleteSub(namespacedKey(r, ""), rq.Sub)
+
+	rs := rsDelete{Removed: removed}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP inspect, admin diagnostics for a single key
+ */
+
+type rsInspectSub struct {
+	Sub        string `json:"sub"`
+	Value      string `json:"value"`
+	Encoding   string `json:"encoding,omitempty"`
+	Updated    int64  `json:"updated"`
+	Version    uint64 `json:"version"`
+	TtlSeconds int64  `json:"ttl_seconds,omitempty"`
+	Expires    int64  `json:"expires,omitempty"` // unix millis
+	Expired    bool   `json:"expired"`
+}
+
+type rsInspect struct {
+	Key        string         `json:"key"`
+	KeyVersion uint64         `json:"key_version"`
+	Accessed   int64          `json:"accessed"` // unix millis
+	SubList    []rsInspectSub `json:"sub_list"`
+}
+
+func httpInspect(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		sendJsonError(w, http.StatusBadRequest, "Key must not be empty")
+		return
+	}
+
+	detail, ok := gCache.inspect(key)
+	if !ok {
+		sendJsonError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	now := time.Now()
+	subList := make([]rsInspectSub, 0, len(detail.l))
+	for _, item := range detail.l {
+		sub := rsInspectSub{
+			Sub:        item.sub,
+			Value:      item.value,
+			Encoding:   item.encoding,
+			Updated:    item.updated,
+			Version:    item.version,
+			TtlSeconds: int64(item.ttl / time.Second),
+			Expired:    item.isExpired(now),
+		}
+		if !item.expires.IsZero() {
+			sub.Expires = item.expires.UnixMilli()
+		}
+		subList = append(subList, sub)
+	}
+
+	rs := rsInspect{
+		Key:        detail.key,
+		KeyVersion: detail.modified,
+		Accessed:   time.Unix(0, detail.accessed).UnixMilli(),
+		SubList:    subList,
+	}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP clear
+ */
+
+type rsClear struct {
+	Removed int `json:"removed"`
+}
+
+func httpClear(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	removed := gCache.clear()
+
+	rs := rsClear{Removed: removed}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP export and import, in the same format as the persist file
+ */
+
+func httpExport(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	entryList, _ := gCache.snapshot()
+
+	rs := persistData{EntryList: entryList}
+	sendJsonResponse(w, r, &rs)
+}
+
+type rsImport struct {
+	Count int `json:"count"`
+}
+
+func httpImport(w http.ResponseWriter, r *http.Request) {
+	var rq persistData
+
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	// Replace is as destructive as /clear
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "", "merge":
+	case "replace":
+		if !gFlags.allowClear {
+			sendJsonError(w, http.StatusForbidden, "Replace mode requires -allow-clear")
+			return
+		}
+	default:
+		sendJsonError(w, http.StatusBadRequest, fmt.Sprintf("Unknown import mode: %s", mode))
+		return
+	}
+
+	status, message := readHttpRequestLimit(r, &rq, maxImportSize)
+	if status != http.StatusOK {
+		sendJsonError(w, status, message)
+		return
+	}
+
+	// Same checks as put, key and sub limits are applied by the cache. The
+	// namespace is a separate field so a key can't put an entry into one
+	for i, pe := range rq.EntryList {
+		status, message = validatePut(&rqPut{Key: pe.Key, Sub: pe.Sub, Value: pe.Value, Weight: pe.Weight})
+		if status == http.StatusOK && (strings.Contains(pe.Namespace, namespaceSeparator) || strings.Contains(pe.Key, namespaceSeparator)) {
+			status, message = http.StatusBadRequest, "Namespace and key must not contain a NUL character"
+		}
+		if status == http.StatusOK && (pe.Ttl < 0 || pe.Ttl > maxTtlSeconds*1000) {
+			status, message = http.StatusBadRequest, fmt.Sprintf("Ttl must be between 0 and %d milliseconds", maxTtlSeconds*1000)
+		}
+		if status != http.StatusOK {
+			sendJsonError(w, status, fmt.Sprintf("Entry %d: %s", i, message))
+			return
+		}
+	}
+
+	if isClientGone(w, r) {
+		return
+	}
+
+	if mode == "replace" {
+		gCache.restore(rq.EntryList)
+	} else {
+		gCache.merge(rq.EntryList)
+	}
+
+	rs := rsImport{Count: len(rq.EntryList)}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP list
+ */
+
+type rsListKey struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+func parseListParam(r *http.Request, name string) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// The response is {"key_list":[...],"next_offset":n}, streamed one key at a
+// time so that large caches don't need the whole response in memory. Keys are
+// sorted, paged with the offset and limit query parameters, and next_offset is
+// only present when there are more keys
+func httpList(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	offset, ok := parseListParam(r, "offset")
+	if !ok {
+		sendJsonError(w, http.StatusBadRequest, "Invalid offset")
+		return
+	}
+	limit, ok := parseListParam(r, "limit")
+	if !ok {
+		sendJsonError(w, http.StatusBadRequest, "Invalid limit")
+		return
+	}
+	if gFlags.maxListLimit > 0 && (limit == 0 || limit > gFlags.maxListLimit) {
+		limit = gFlags.maxListLimit
+	}
+
+	keyInfoList := gCache.keys()
+	sort.Slice(keyInfoList, func(i, j int) bool {
+		return keyInfoList[i].key < keyInfoList[j].key
+	})
+
+	nextOffset := 0
+	keyInfoList = keyInfoList[min(offset, len(keyInfoList)):]
+	if limit > 0 && len(keyInfoList) > limit {
+		keyInfoList = keyInfoList[:limit]
+		nextOffset = offset + limit
+	}
+
+	out, done := startJsonResponse(w, r, http.StatusOK)
+	defer done()
+
+	if _, err := io.WriteString(out, `{"key_list":[`); err != nil {
+		return
+	}
+
+	for i, item := range keyInfoList {
+		data, err := json.Marshal(&rsListKey{Key: item.key, Count: item.count})
+		if err != nil {
+			return
+		}
+		if i > 0 {
+			data = append([]byte{','}, data...)
+		}
+		if _, err = out.Write(data); err != nil {
+			return
+		}
+	}
+
+	if nextOffset > 0 {
+		_, _ = fmt.Fprintf(out, "],\"next_offset\":%d}\n", nextOffset)
+	} else {
+		_, _ = io.WriteString(out, "]}\n")
+	}
+}
+
+/**
+ * HTTP stats
+ */
+
+type rsStats struct {
+	KeyCount          int     `json:"key_count"`
+	SubCount          int     `json:"sub_count"`
+	UptimeSeconds     float64 `json:"uptime_seconds"`
+	MemAlloc          uint64  `json:"mem_alloc"`
+	MemSys            uint64  `json:"mem_sys"`
+	ActiveConnections int64   `json:"active_connections"`
+}
+
+func httpStats(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	keyCount, subCount := gCache.stats()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	rs := rsStats{
+		KeyCount:          keyCount,
+		SubCount:          subCount,
+		UptimeSeconds:     time.Since(gStartTime).Seconds(),
+		MemAlloc:          memStats.Alloc,
+		MemSys:            memStats.Sys,
+		ActiveConnections: gActiveConns.Load(),
+	}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * Prometheus metrics
+ */
+
+var (
+	metricRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "discover_requests_total",
+		Help: "Number of requests by endpoint",
+	}, []string{"endpoint"})
+
+	metricDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "discover_request_duration_seconds",
+		Help:    "Request duration by endpoint",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "discover_keys",
+		Help: "Current number of keys",
+	}, func() float64 {
+		keyCount, _ := gCache.stats()
+		return float64(keyCount)
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "discover_subs",
+		Help: "Current number of subs across all keys",
+	}, func() float64 {
+		_, subCount := gCache.stats()
+		return float64(subCount)
+	})
+)
+
+func withMetrics(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	observer := metricDuration.WithLabelValues(endpoint)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h(w, r)
+		observer.Observe(time.Since(start).Seconds())
+	}
+}
+
+/**
+ * HTTP version, set at build time with e.g.
+ * go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD)"
+ */
+
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+type rsVersion struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func httpVersion(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+
+	if !checkHttpMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	rs := rsVersion{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP health and ready
+ */
+
+type rsHealth struct {
+	Status string `json:"status"`
+}
+
+func httpHealth(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+
+	rs := rsHealth{Status: "ok"}
+	sendJsonResponse(w, r, &rs)
+}
+
+func httpReady(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+
+	if !isLoaded() {
+		rs := rsHealth{Status: "loading"}
+		sendJsonResponseStatus(w, r, http.StatusServiceUnavailable, &rs)
+		return
+	}
+	if !isReady() {
+		rs := rsHealth{Status: "not ready"}
+		sendJsonResponseStatus(w, r, http.StatusServiceUnavailable, &rs)
+		return
+	}
+
+	rs := rsHealth{Status: "ok"}
+	sendJsonResponse(w, r, &rs)
+}
+
+/**
+ * HTTP loop
+ */
+
+func newHttpServer(address string, flags *Flags, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:         address,
+		Handler:      handler,
+		ReadTimeout:  time.Duration(flags.readTimeout) * time.Second,
+		WriteTimeout: time.Duration(flags.writeTimeout) * time.Second,
+		IdleTimeout:  time.Duration(flags.idleTimeout) * time.Second,
+	}
+	if flags.h2c && flags.certFile == "" {
+		// HTTP/2 without TLS, with TLS it's negotiated anyway
+		server.Handler = h2c.NewHandler(handler, &http2.Server{
+			IdleTimeout: server.IdleTimeout,
+		})
+	}
+	if flags.certFile != "" {
+		// Validated on startup
+		minVersion, _ := parseTlsVersion(flags.minTlsVersion)
+		server.TLSConfig = &tls.Config{MinVersion: minVersion}
+	}
+	if flags.disableKeepAlive {
+		// For intermediaries which mishandle keep-alive, responses will have
+		// Connection: close
+		server.SetKeepAlivesEnabled(false)
+	}
+	return server
+}
+
+func parseTlsVersion(value string) (uint16, error) {
+	switch value {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %s, must be one of 1.0, 1.1, 1.2, 1.3", value)
+}
+
+func httpLoop(server *http.Server, flags *Flags) {
+	var err error
+	var listener net.Listener
+
+	slog.Info("Listening on http", "address", server.Addr)
+
+	if flags.unixSocket != "" {
+		// The socket file is removed when the listener is closed on shutdown
+		listener, err = net.Listen("unix", server.Addr)
+	} else {
+		var lc net.ListenConfig
+		if flags.reusePort {
+			lc.Control = reusePortControl
+		}
+		listener, err = lc.Listen(context.Background(), "tcp", server.Addr)
+	}
+	if err != nil {
+		fatal("cannot listen on http", err)
+	}
+
+	listener = newLimitListener(listener, gConnSlots)
+
+	if flags.certFile != "" && flags.keyFile != "" {
+		err = server.ServeTLS(listener, flags.certFile, flags.keyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("cannot listen on http", err)
+	}
+}
+
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		fatal("cannot listen on unix socket", fmt.Errorf("%s exists and is not a socket", path))
+	}
+
+	slog.Info("Removing stale unix socket", "path", path)
+	if err := os.Remove(path); err != nil {
+		fatal("cannot remove stale unix socket", err)
+	}
+}
+
+/**
+ * Listener which counts active connections and optionally limits them, shared
+ * by all listeners. Once the limit is reached Accept blocks until a connection
+ * is closed, so new connections queue in the kernel backlog
+ */
+
+var gActiveConns atomic.Int64
+
+// Nil for unlimited
+var gConnSlots chan struct{}
+
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(l net.Listener, slots chan struct{}) *limitListener {
+	return &limitListener{
+		Listener: l,
+		slots:    slots,
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+
+	gActiveConns.Add(1)
+	return &limitConn{Conn: conn, listener: l}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *limitListener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	listener  *limitListener
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		gActiveConns.Add(-1)
+		c.listener.release()
+	})
+	return err
+}
+
+/**
+ * Mux which remembers its routes, for listing them in the not found response
+ */
+
+type routeMux struct {
+	*http.ServeMux
+	patternList []string
+}
+
+func newRouteMux() *routeMux {
+	return &routeMux{
+		ServeMux:    http.NewServeMux(),
+		patternList: make([]string, 0),
+	}
+}
+
+func (m *routeMux) Handle(pattern string, h http.Handler) {
+	m.ServeMux.Handle(pattern, h)
+	m.patternList = append(m.patternList, pattern)
+}
+
+func (m *routeMux) HandleFunc(pattern string, h func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(h))
+}
+
+type rsNotFound struct {
+	Error     string   `json:"error"`
+	Available []string `json:"available"`
+}
+
+// Handles everything not matched by other routes
+func (m *routeMux) notFound(w http.ResponseWriter, r *http.Request) {
+	rs := rsNotFound{Error: "unknown endpoint", Available: m.patternList}
+	sendJsonResponseStatus(w, r, http.StatusNotFound, &rs)
+}
+
+/**
+ * Profiling, on its own address to keep it off the data port
+ */
+
+func newPprofServer(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+}
+
+func pprofLoop(server *http.Server) {
+	slog.Info("Listening for pprof", "address", server.Addr)
+
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("cannot listen for pprof", err)
+	}
+}
+
+/**
+ * UDP discovery, for clients that don't know the server's address and
+ * broadcast a request to find it, the reply has the URL of the HTTP server
+ */
+
+const udpDiscoveryRequest = "simple_discover_server?"
+
+type rsUdpDiscovery struct {
+	Url string `json:"url"`
+}
+
+func udpDiscoveryLoop(conn net.PacketConn, listenIP net.IP, listenPort int, scheme string) {
+	slog.Info("Listening for UDP discovery", "address", conn.LocalAddr().String())
+
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Cannot read UDP discovery request", "err", err)
+			continue
+		}
+		if strings.TrimSpace(string(buf[:n])) != udpDiscoveryRequest {
+			continue
+		}
+
+		ip := listenIP
+		if ip.IsUnspecified() {
+			if ip = localAddressTo(addr); ip == nil {
+				continue
+			}
+		}
+
+		rs := rsUdpDiscovery{Url: scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(listenPort))}
+		data, _ := json.Marshal(&rs)
+		if _, err := conn.WriteTo(data, addr); err != nil {
+			slog.Debug("Cannot send UDP discovery reply", "address", addr.String(), "err", err)
+		}
+	}
+}
+
+// Returns the address of the interface which routes to addr, "dialing" UDP
+// doesn't send anything
+func localAddressTo(addr net.Addr) net.IP {
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+/**
+ * mDNS / DNS-SD advertisement, so clients on the LAN can find the server
+ */
+
+const defaultMdnsService = "_discover._tcp"
+
+func registerMdns(service string, listenPort int) (*zeroconf.Server, error) {
+	instance, err := os.Hostname()
+	if err != nil || instance == "" {
+		instance = "simple_discover_server"
+	}
+
+	server, err := zeroconf.Register(instance, service, "local.", listenPort, []string{"version=" + version}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Advertising over mDNS", "instance", instance, "service", service, "port", listenPort)
+	return server, nil
+}
+
+/**
+ * Expire loop
+ */
+
+func expireLoop() {
+	for {
+		time.Sleep(expireSweepInterval)
+		if removed := gCache.expire(); removed > 0 {
+			slog.Info("Expired entries", "count", removed)
+		}
+		gIdempotency.expire()
+		if gRateLimiter != nil {
+			gRateLimiter.expireIdle()
+		}
+	}
+}
+
+/**
+ * Flags
+ */
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type Flags struct {
+	listenInterface string
+	listenAddress   stringList
+	listenPort      int
+	certFile        string
+	keyFile         string
+	minTlsVersion   string
+	apiKey          string
+	readTimeout     int
+	writeTimeout    int
+	idleTimeout     int
+	persistFile     string
+	defaultsFile    string
+	wal             bool
+	snapshotSecs    int
+	logLevel        string
+	maxSubsPerKey   int
+	maxKeys         int
+	allowClear      bool
+	maxKeySize      int
+	maxValueSize    int
+	maxRequestSize  int
+	maxListLimit    int
+	preferIPv6      bool
+	unixSocket      string
+	corsOrigin      string
+	accessLog       bool
+	configFile      string
+	reusePort       bool
+	pprofAddress    string
+	udpDiscovery    string
+	mdnsService     string
+	maxConnections  int
+	maxInflight     int
+	ttlJitter       int
+	rateLimit       float64
+
+	caseInsensitiveKeys bool
+	allowUnknownFields  bool
+	disableKeepAlive    bool
+	h2c                 bool
+	pretty              bool
+	mdns                bool
+}
+
+var gFlags Flags
+
+/**
+ * Defaults file, a JSON object with values keyed by key, returned by /get for
+ * keys without any values. The keys are outside of any namespace
+ */
+
+const defaultSub = "default"
+
+var gDefaults map[string]string
+
+func loadDefaults(fileName string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := make(map[string]string)
+	if err = json.Unmarshal(data, &defaults); err != nil {
+		return nil, err
+	}
+	return defaults, nil
+}
+
+/**
+ * Config file, a JSON object with values keyed by flag name, used for flags
+ * not given on the command line
+ */
+
+func applyConfigFile(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	config := make(map[string]interface{})
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+	if err = decoder.Decode(&config); err != nil {
+		return err
+	}
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	nameList := make([]string, 0, len(config))
+	for name := range config {
+		nameList = append(nameList, name)
+	}
+	sort.Strings(nameList)
+
+	for _, name := range nameList {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if setFlags[name] {
+			continue
+		}
+
+		// Arrays are for flags which can be repeated
+		valueList, ok := config[name].([]interface{})
+		if !ok {
+			valueList = []interface{}{config[name]}
+		}
+		for _, value := range valueList {
+			if err = flag.Set(name, fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("invalid value for %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Environment variables, used for flags not given on the command line
+ */
+
+func applyEnvironment(flags *Flags) {
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	// An interface or addresses from the command line override both
+	if !setFlags["i"] && !setFlags["a"] {
+		if value := os.Getenv("DISCOVER_LISTEN_INTERFACE"); value != "" {
+			flags.listenInterface = value
+		}
+		if value := os.Getenv("DISCOVER_LISTEN_ADDRESS"); value != "" {
+			for _, address := range strings.Split(value, ",") {
+				flags.listenAddress = append(flags.listenAddress, strings.TrimSpace(address))
+			}
+		}
+	}
+
+	if !setFlags["p"] {
+		if value := os.Getenv("DISCOVER_LISTEN_PORT"); value != "" {
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				slog.Error("Invalid listen port in DISCOVER_LISTEN_PORT", "port", value)
+				os.Exit(1)
+			}
+			flags.listenPort = port
+		}
+	}
+}
+
+/**
+ * Get address for an interface
+ */
+
+func findInterfaceAddress(ifaceName string, preferIPv6 bool) (net.IP, error) {
+	ifaceList, err := net.Interfaces()
+	if err != nil {
+		fatal("cannot get local interface list", err)
+	}
+	for _, iface := range ifaceList {
+		if iface.Name == ifaceName {
+			addrList, err := iface.Addrs()
+			if err != nil {
+				fatal("cannot get address list", err)
+			}
+
+			// Skip addresses which can't be usefully bound to, loopback
+			// is only allowed on the loopback interface itself
+			isLoopback := iface.Flags&net.FlagLoopback != 0
+			var foundIPv4, foundIPv6 net.IP
+			for _, addr := range addrList {
+				switch v := addr.(type) {
+				case *net.IPNet:
+					slog.Info("Interface address", "interface", iface.Name, "address", v.String())
+					if (v.IP.IsLoopback() && !isLoopback) || v.IP.IsLinkLocalUnicast() || v.IP.IsMulticast() {
+						continue
+					}
+					if v.IP.To4() != nil {
+						if foundIPv4 == nil {
+							foundIPv4 = v.IP
+						}
+					} else if foundIPv6 == nil {
+						foundIPv6 = v.IP
+					}
+				}
+			}
+
+			if preferIPv6 && foundIPv6 != nil {
+				return foundIPv6, nil
+			}
+			if foundIPv4 != nil {
+				return foundIPv4, nil
+			}
+			if foundIPv6 != nil {
+				return foundIPv6, nil
+			}
+			return nil, fmt.Errorf("interface %s has no usable address", ifaceName)
+		}
+	}
+
+	return nil, fmt.Errorf("interface %s not found", ifaceName)
+}
+
+/**
+ * Loading of saved state, runs after the servers start, until it's done data
+ * endpoints return 503 so clients don't act on a transiently empty cache
+ */
+
+func loadSavedState() {
+	// Load saved state
+	if gFlags.persistFile != "" {
+		err := loadCache(gCache, gFlags.persistFile)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Warn("Cannot load cache, starting empty", "file", gFlags.persistFile, "err", err)
+		}
+	}
+
+	if gFlags.wal {
+		walFile := gFlags.persistFile + ".wal"
+		walFileList := []string{walFile + ".old", walFile}
+
+		for _, fileName := range walFileList {
+			count, err := replayWal(gCache, fileName)
+			if err != nil && !os.IsNotExist(err) {
+				slog.Warn("Cannot fully replay write ahead log", "file", fileName, "count", count, "err", err)
+			} else if count > 0 {
+				slog.Info("Replayed write ahead log", "file", fileName, "count", count)
+			}
+		}
+
+		// Compact into the persist file and start with an empty log, which
+		// also drops any truncated last record
+		if _, err := saveCache(gCache, gFlags.persistFile); err != nil {
+			fatal("cannot save cache", err)
+		}
+		for _, fileName := range walFileList {
+			if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				fatal("cannot remove write ahead log", err)
+			}
+		}
+
+		wal, err := openWal(walFile)
+		if err != nil {
+			fatal("cannot open write ahead log", err)
+		}
+		gCache.wal = wal
+	}
+}
+
+/**
+ * Main
+ */
+
+func main() {
+	// Parse flags
+	flag.StringVar(&gFlags.configFile, "config", "", "JSON config file with values keyed by flag name, command line flags take precedence")
+	flag.StringVar(&gFlags.listenInterface, "i", "", "Listen interface")
+	flag.BoolVar(&gFlags.preferIPv6, "prefer-ipv6", false, "Prefer an IPv6 address on the listen interface")
+	flag.Var(&gFlags.listenAddress, "a", "Listen address, can be repeated")
+	flag.IntVar(&gFlags.listenPort, "p", 65001, "Listen port")
+	flag.BoolVar(&gFlags.reusePort, "reuseport", false, "Set SO_REUSEPORT so several processes can listen on the same port, Linux only")
+	flag.StringVar(&gFlags.unixSocket, "unix", "", "Listen on a unix socket at this path instead of TCP")
+	flag.StringVar(&gFlags.certFile, "cert", "", "TLS certificate file")
+	flag.StringVar(&gFlags.keyFile, "key", "", "TLS private key file")
+	flag.StringVar(&gFlags.minTlsVersion, "min-tls-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2, 1.3")
+	flag.StringVar(&gFlags.corsOrigin, "cors-origin", "", "Value for the Access-Control-Allow-Origin header, empty to disable CORS")
+	flag.StringVar(&gFlags.apiKey, "apikey", "", "API key required in the "+apiKeyHeader+" header")
+	flag.IntVar(&gFlags.readTimeout, "read-timeout", 10, "HTTP read timeout, seconds")
+	flag.IntVar(&gFlags.writeTimeout, "write-timeout", 10, "HTTP write timeout, seconds")
+	flag.IntVar(&gFlags.idleTimeout, "idle-timeout", 60, "HTTP idle timeout, seconds")
+	flag.BoolVar(&gFlags.h2c, "h2c", false, "Accept HTTP/2 without TLS")
+	flag.BoolVar(&gFlags.disableKeepAlive, "disable-keepalive", false, "Disable HTTP keep-alive, closing the connection after every response")
+	flag.StringVar(&gFlags.defaultsFile, "defaults", "", "JSON file with default values keyed by key, returned by /get when a key has no values")
+	flag.StringVar(&gFlags.persistFile, "persist", "", "File to save the cache to on shutdown and load from on startup")
+	flag.BoolVar(&gFlags.wal, "wal", false, "Append every change to a write ahead log next to the persist file, replayed on startup")
+	flag.IntVar(&gFlags.snapshotSecs, "snapshot-interval", 0, "Interval for saving the cache to the persist file, seconds, 0 to only save on shutdown")
+	flag.StringVar(&gFlags.logLevel, "log-level", "info", "Log level: debug, info, warn, error")
+	flag.IntVar(&gFlags.maxInflight, "max-inflight", 0, "Maximum number of requests handled at the same time, more are rejected with 503, 0 for unlimited")
+	flag.Float64Var(&gFlags.rateLimit, "rate-limit", 0, "Maximum requests per second from each client address, 0 for unlimited")
+	flag.IntVar(&gFlags.maxConnections, "max-connections", 0, "Maximum number of concurrent connections, more are queued, 0 for unlimited")
+	flag.BoolVar(&gFlags.accessLog, "access-log", false, "Log every request")
+	flag.BoolVar(&gFlags.pretty, "pretty", false, "Indent JSON responses for reading by eye")
+	flag.StringVar(&gFlags.pprofAddress, "pprof", "", "Address for pprof endpoints, e.g. 127.0.0.1:6060, empty to disable")
+	flag.StringVar(&gFlags.udpDiscovery, "udp-discovery", "", "Address for answering UDP discovery broadcasts with the server URL, e.g. :18002, empty to disable")
+	flag.BoolVar(&gFlags.mdns, "mdns", false, "Advertise the server over mDNS")
+	flag.StringVar(&gFlags.mdnsService, "mdns-service", defaultMdnsService, "Service type for mDNS advertisement")
+	flag.IntVar(&gFlags.maxSubsPerKey, "max-subs-per-key", 0, "Maximum number of subs per key, oldest are evicted, 0 for unlimited")
+	flag.IntVar(&gFlags.maxKeys, "max-keys", 0, "Maximum number of keys, least recently used are evicted, 0 for unlimited")
+	flag.IntVar(&gFlags.ttlJitter, "ttl-jitter", 0, "Randomly extend entry expiration by up to this percentage of the ttl")
+	flag.BoolVar(&gFlags.caseInsensitiveKeys, "case-insensitive-keys", false, "Match keys ignoring case")
+	flag.BoolVar(&gFlags.allowClear, "allow-clear", false, "Allow admin endpoints, /clear which wipes the entire cache and /inspect")
+	flag.IntVar(&gFlags.maxKeySize, "max-key-size", 256, "Maximum key and sub size, bytes, 0 for unlimited")
+	flag.IntVar(&gFlags.maxValueSize, "max-value-size", 4096, "Maximum value size, bytes, 0 for unlimited")
+	flag.IntVar(&gFlags.maxRequestSize, "max-request-size", defaultMaxRequestSize, "Maximum HTTP request body size, bytes")
+	flag.IntVar(&gFlags.maxListLimit, "max-list-limit", 0, "Maximum number of keys returned by /list in one page, 0 for unlimited")
+	flag.BoolVar(&gFlags.allowUnknownFields, "allow-unknown-fields", false, "Ignore unknown fields in requests instead of rejecting them")
+	flag.Parse()
+
+	if gFlags.configFile != "" {
+		if err := applyConfigFile(gFlags.configFile); err != nil {
+			fmt.Printf("Error: cannot load config file %s: %v\n", gFlags.configFile, err)
+			os.Exit(1)
+		}
+	}
+
+	// Set up logging
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(gFlags.logLevel)); err != nil {
+		fmt.Printf("Error: invalid log level %s\n", gFlags.logLevel)
+		os.Exit(1)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})))
+
+	slog.Info("Hello this is simple discover server", "version", version, "commit", commit)
+
+	applyEnvironment(&gFlags)
+
+	if gFlags.listenPort <= 0 || gFlags.listenPort > 65535 {
+		slog.Error("Invalid listen port", "port", gFlags.listenPort)
+		os.Exit(1)
+	}
+
+	if gFlags.maxRequestSize <= 0 {
+		slog.Error("Invalid maximum request size", "size", gFlags.maxRequestSize)
+		os.Exit(1)
+	}
+
+	if gFlags.maxConnections < 0 {
+		slog.Error("Invalid maximum connections", "count", gFlags.maxConnections)
+		os.Exit(1)
+	}
+	if gFlags.maxConnections > 0 {
+		gConnSlots = make(chan struct{}, gFlags.maxConnections)
+	}
+
+	if gFlags.maxInflight < 0 {
+		slog.Error("Invalid maximum in-flight requests", "count", gFlags.maxInflight)
+		os.Exit(1)
+	}
+
+	if gFlags.rateLimit < 0 {
+		slog.Error("Invalid rate limit", "rate", gFlags.rateLimit)
+		os.Exit(1)
+	}
+	if gFlags.rateLimit > 0 {
+		gRateLimiter = newRateLimiter(gFlags.rateLimit)
+	}
+
+	if gFlags.ttlJitter < 0 || gFlags.ttlJitter > 100 {
+		slog.Error("Invalid ttl jitter, must be between 0 and 100", "percent", gFlags.ttlJitter)
+		os.Exit(1)
+	}
+
+	if gFlags.readTimeout < 0 || gFlags.writeTimeout < 0 || gFlags.idleTimeout < 0 {
+		slog.Error("Invalid HTTP timeout")
+		os.Exit(1)
+	}
+
+	if gFlags.reusePort && !reusePortSupported {
+		slog.Warn("SO_REUSEPORT is not supported on this platform, ignoring -reuseport")
+		gFlags.reusePort = false
+	}
+
+	if (gFlags.certFile == "") != (gFlags.keyFile == "") {
+		fatal("invalid TLS configuration", errors.New("both -cert and -key must be specified"))
+	}
+	if _, err := parseTlsVersion(gFlags.minTlsVersion); err != nil {
+		fatal("invalid TLS configuration", err)
+	}
+
+	if gFlags.wal && gFlags.persistFile == "" {
+		fatal("invalid write ahead log configuration", errors.New("-wal requires -persist"))
+	}
+
+	if gFlags.udpDiscovery != "" && gFlags.unixSocket != "" {
+		fatal("invalid UDP discovery configuration", errors.New("-udp-discovery cannot be used with -unix"))
+	}
+	if gFlags.mdns && gFlags.unixSocket != "" {
+		fatal("invalid mDNS configuration", errors.New("-mdns cannot be used with -unix"))
+	}
+
+	// Set up the cache
+	gCache.maxSubsPerKey = gFlags.maxSubsPerKey
+	gCache.maxKeys = gFlags.maxKeys
+	gCache.caseInsensitiveKeys = gFlags.caseInsensitiveKeys
+	gCache.ttlJitter = float64(gFlags.ttlJitter) / 100
+
+	if gFlags.defaultsFile != "" {
+		defaults, err := loadDefaults(gFlags.defaultsFile)
+		if err != nil {
+			fatal("cannot load defaults file", err)
+		}
+		gDefaults = defaults
+		slog.Info("Loaded defaults", "file", gFlags.defaultsFile, "count", len(defaults))
+	}
+
+	// Listen on HTTP
+	mux := newRouteMux()
+	mux.HandleFunc("/put", withApiKey(gFlags.apiKey, withLoaded(withMetrics("put", httpPut))))
+	mux.HandleFunc("/cas", withApiKey(gFlags.apiKey, withLoaded(httpCas)))
+	mux.HandleFunc("/put-batch", withApiKey(gFlags.apiKey, withLoaded(httpPutBatch)))
+	mux.HandleFunc("/put-merge", withApiKey(gFlags.apiKey, withLoaded(httpPutMerge)))
+	mux.HandleFunc("/incr", withApiKey(gFlags.apiKey, withLoaded(httpIncr)))
+	mux.HandleFunc("/get", withApiKey(gFlags.apiKey, withLoaded(withMetrics("get", httpGet))))
+	mux.HandleFunc("/get-one", withApiKey(gFlags.apiKey, withLoaded(httpGetOne)))
+	mux.HandleFunc("/get-batch", withApiKey(gFlags.apiKey, withLoaded(httpGetBatch)))
+	mux.HandleFunc("/get-prefix", withApiKey(gFlags.apiKey, withLoaded(httpGetPrefix)))
+	mux.HandleFunc("/count-prefix", withApiKey(gFlags.apiKey, withLoaded(httpCountPrefix)))
+	mux.HandleFunc("/heartbeat", withApiKey(gFlags.apiKey, withLoaded(httpHeartbeat)))
+	mux.HandleFunc("/delete", withApiKey(gFlags.apiKey, withLoaded(withMetrics("delete", httpDelete))))
+	mux.HandleFunc("/delete-key", withApiKey(gFlags.apiKey, withLoaded(httpDeleteKey)))
+	mux.HandleFunc("/delete-sub", withApiKey(gFlags.apiKey, withLoaded(httpDeleteSub)))
+	mux.HandleFunc("/watch", withApiKey(gFlags.apiKey, withLoaded(httpWatch)))
+	mux.HandleFunc("/list", withApiKey(gFlags.apiKey, withLoaded(httpList)))
+	mux.HandleFunc("/clear", withApiKey(gFlags.apiKey, withLoaded(withAllowed(gFlags.allowClear, httpClear))))
+	mux.HandleFunc("/inspect", withApiKey(gFlags.apiKey, withLoaded(withAllowed(gFlags.allowClear, httpInspect))))
+	mux.HandleFunc("/export", withApiKey(gFlags.apiKey, withLoaded(httpExport)))
+	mux.HandleFunc("/import", withApiKey(gFlags.apiKey, withLoaded(httpImport)))
+	mux.HandleFunc("/stats", withApiKey(gFlags.apiKey, httpStats))
+	mux.HandleFunc("/ns/{namespace}/{endpoint}", withNamespace(mux))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health", httpHealth)
+	mux.HandleFunc("/ready", httpReady)
+	mux.HandleFunc("/version", httpVersion)
+	mux.ServeMux.HandleFunc("/", mux.notFound)
+
+	// Probes bypass the rate and inflight limits, a busy server is still alive
+	limitMux := http.NewServeMux()
+	limitMux.Handle("/", withRateLimit(gRateLimiter, withInflightLimit(gFlags.maxInflight, mux)))
+	limitMux.Handle("/health", mux)
+	limitMux.Handle("/ready", mux)
+
+	handler := withRequestId(withAccessLog(gFlags.accessLog, withCors(gFlags.corsOrigin, limitMux)))
+
+	listenIPList := make([]net.IP, 0)
+	if gFlags.unixSocket != "" {
+		// On a unix socket, see below
+	} else if gFlags.listenInterface != "" {
+		// On a specific interface
+		findIP, err := findInterfaceAddress(gFlags.listenInterface, gFlags.preferIPv6)
+		if err != nil {
+			fatal("cannot listen on interface", err)
+		}
+		listenIPList = append(listenIPList, findIP)
+	} else {
+		// On specific addresses
+		for _, address := range gFlags.listenAddress {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				fatal("invalid listen address", fmt.Errorf("%q is not an IP address", address))
+			}
+			listenIPList = append(listenIPList, ip)
+		}
+	}
+	if len(listenIPList) == 0 {
+		listenIPList = append(listenIPList, net.IPv4(0, 0, 0, 0))
+	}
+	listenPort := gFlags.listenPort
+
+	listenAddressList := make([]string, 0)
+	if gFlags.unixSocket != "" {
+		removeStaleSocket(gFlags.unixSocket)
+		listenAddressList = append(listenAddressList, gFlags.unixSocket)
+	} else {
+		for _, listenIP := range listenIPList {
+			listenAddressList = append(listenAddressList, net.JoinHostPort(listenIP.String(), strconv.Itoa(listenPort)))
+		}
+	}
+
+	serverList := make([]*http.Server, 0)
+	for _, listenAddress := range listenAddressList {
+		server := newHttpServer(listenAddress, &gFlags, handler)
+		serverList = append(serverList, server)
+
+		go httpLoop(server, &gFlags)
+	}
+
+	if gFlags.pprofAddress != "" {
+		server := newPprofServer(gFlags.pprofAddress)
+		serverList = append(serverList, server)
+
+		go pprofLoop(server)
+	}
+
+	if gFlags.udpDiscovery != "" {
+		conn, err := net.ListenPacket("udp", gFlags.udpDiscovery)
+		if err != nil {
+			fatal("cannot listen for UDP discovery", err)
+		}
+		defer conn.Close()
+
+		scheme := "http"
+		if gFlags.certFile != "" {
+			scheme = "https"
+		}
+		go udpDiscoveryLoop(conn, listenIPList[0], listenPort, scheme)
+	}
+
+	var mdnsServer *zeroconf.Server
+	if gFlags.mdns {
+		var err error
+		mdnsServer, err = registerMdns(gFlags.mdnsService, listenPort)
+		if err != nil {
+			fatal("cannot advertise over mDNS", err)
+		}
+	}
+
+	go expireLoop()
+
+	go func() {
+		loadSavedState()
+		setLoaded()
+
+		if gFlags.persistFile != "" && gFlags.snapshotSecs > 0 {
+			go snapshotLoop(gCache, gFlags.persistFile, time.Duration(gFlags.snapshotSecs)*time.Second)
+		} else if gFlags.wal {
+			// Keep the log from growing without bound
+			go snapshotLoop(gCache, gFlags.persistFile, walCompactInterval)
+		}
+
+		setReady(true)
+	}()
+
+	// Wait for a shutdown signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	// Notify with no signals would mean all signals
+	dumpChan := make(chan os.Signal, 1)
+	if len(dumpSignals) > 0 {
+		signal.Notify(dumpChan, dumpSignals...)
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			keyCount, subCount := gCache.stats()
+			slog.Info("Still running", "keys", keyCount, "subs", subCount)
+		case <-dumpChan:
+			go func() {
+				fileName, err := dumpCache(gCache, gFlags.persistFile)
+				if err != nil {
+					slog.Error("Cannot dump cache", "err", err)
+					return
+				}
+				slog.Info("Dumped cache", "file", fileName)
+			}()
+		case sig := <-sigChan:
+			slog.Info("Shutting down", "signal", sig.String())
+			setReady(false)
+			running = false
+		}
+	}
+
+	// Stop advertising before going away
+	if mdnsServer != nil {
+		mdnsServer.Shutdown()
+	}
+
+	// Drain in-flight requests
+	close(gShutdownChan)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, server := range serverList {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down http", "address", server.Addr, "err", err)
+		}
+	}
+
+	// Save state, unless loading hasn't finished which would lose data
+	if !isLoaded() {
+		slog.Warn("Not saving cache, still loading")
+	} else if gFlags.persistFile != "" {
+		_, err := saveCache(gCache, gFlags.persistFile)
+		if err != nil {
+			slog.Error("Cannot save cache", "file", gFlags.persistFile, "err", err)
+		}
+	}
+	if isLoaded() && gCache.wal != nil {
+		gCache.wal.close()
+	}
+
+	slog.Info("Goodbye")
 }
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/**
+ * Reads return copies
+ */
+
+func TestCacheGetReturnsCopies(t *testing.T) {
+	c := newCache()
+	c.put("key", "sub", "value", "", 0, time.Hour, nil)
+
+	itemList := c.get("key")
+	if len(itemList) != 1 {
+		t.Fatalf("Got %d entries, expected 1", len(itemList))
+	}
+	itemList[0].Value = "changed"
+	itemList[0].Version = 100
+	itemList[0].Expires = time.Time{}
+
+	ce2 := c.m["key"].l[0]
+	if ce2.value != "value" || ce2.version != 1 || ce2.expires.IsZero() {
+		t.Fatalf("Changing the result of get changed the cache: %+v", *ce2)
+	}
+}
+
+func TestCacheInspectReturnsCopies(t *testing.T) {
+	c := newCache()
+	c.put("key", "sub", "value", "", 0, time.Hour, nil)
+
+	detail, ok := c.inspect("key")
+	if !ok || len(detail.l) != 1 {
+		t.Fatalf("Inspect returned %v with %d entries, expected 1", ok, len(detail.l))
+	}
+	detail.l[0].value = "changed"
+	detail.l[0].version = 100
+	detail.l[0].expires = time.Time{}
+
+	ce2 := c.m["key"].l[0]
+	if ce2.value != "value" || ce2.version != 1 || ce2.expires.IsZero() {
+		t.Fatalf("Changing the result of inspect changed the cache: %+v", *ce2)
+	}
+}
+
+/**
+ * Validation
+ */
+
+func TestValidatePutTtl(t *testing.T) {
+	for _, ttlSeconds := range []int64{-1, maxTtlSeconds + 1, math.MaxInt64} {
+		if status, _ := validatePut(&rqPut{Key: "key", Sub: "sub", TtlSeconds: ttlSeconds}); status != http.StatusBadRequest {
+			t.Fatalf("Ttl %d got status %d, expected %d", ttlSeconds, status, http.StatusBadRequest)
+		}
+	}
+	if status, message := validatePut(&rqPut{Key: "key", Sub: "sub", TtlSeconds: maxTtlSeconds}); status != http.StatusOK {
+		t.Fatalf("Maximum ttl got status %d: %s", status, message)
+	}
+}
+
+/**
+ * Expiration
+ */
+
+func TestCacheGetExpiresBeforeSweep(t *testing.T) {
+	c := newCache()
+	c.put("key", "a", "value", "", 0, 0, nil)
+	c.put("key", "b", "value", "", 0, time.Hour, nil)
+
+	_, version, modified := c.getWithModified("key")
+	changes, done := c.changes("key")
+	defer done()
+
+	// Expired but not swept
+	c.m["key"].l[1].expires = time.Now().Add(-time.Second)
+	time.Sleep(2 * time.Millisecond)
+
+	itemList, expiredVersion, expiredModified := c.getWithModified("key")
+	if len(itemList) != 1 {
+		t.Fatalf("Got %d entries, expected 1", len(itemList))
+	}
+	if expiredVersion == version {
+		t.Fatalf("Key version didn't change on expiration")
+	}
+	if !expiredModified.After(modified) {
+		t.Fatalf("Modification time didn't change on expiration")
+	}
+	select {
+	case <-changes:
+	default:
+		t.Fatalf("Waiters not woken up on expiration")
+	}
+}
+
+/**
+ * Waiting for changes
+ */
+
+func TestCacheWaitersRemovedWhenDone(t *testing.T) {
+	c := newCache()
+
+	_, done1 := c.changes("key")
+	_, done2 := c.changes("key")
+	done1()
+	if len(c.waiters) != 1 {
+		t.Fatalf("Waiter removed while still in use")
+	}
+	done2()
+	if len(c.waiters) != 0 {
+		t.Fatalf("Cache has %d waiters after all gave up, expected 0", len(c.waiters))
+	}
+}
+
+func TestCacheWaitersClosedOnChange(t *testing.T) {
+	c := newCache()
+
+	changes, done := c.changes("key")
+	c.put("key", "sub", "value", "", 0, 0, nil)
+
+	select {
+	case <-changes:
+	default:
+		t.Fatalf("Channel not closed by put")
+	}
+	done()
+
+	// A new waiter after the change must not be affected by the old one
+	_, done = c.changes("key")
+	if len(c.waiters) != 1 {
+		t.Fatalf("Cache has %d waiters, expected 1", len(c.waiters))
+	}
+	done()
+	if len(c.waiters) != 0 {
+		t.Fatalf("Cache has %d waiters, expected 0", len(c.waiters))
+	}
+}
+
+/**
+ * Import
+ */
+
+func TestCacheMergeAppliesLimits(t *testing.T) {
+	c := newCache()
+	c.maxKeys = 2
+	c.maxSubsPerKey = 2
+
+	c.merge([]persistEntry{
+		{Key: "a", Sub: "1", Value: "value"},
+		{Key: "a", Sub: "2", Value: "value"},
+		{Key: "a", Sub: "3", Value: "value"},
+		{Key: "b", Sub: "1", Value: "value"},
+		{Key: "c", Sub: "1", Value: "value"},
+	})
+
+	if len(c.m) != 2 {
+		t.Fatalf("Cache has %d keys, expected 2", len(c.m))
+	}
+	for key, ce1 := range c.m {
+		if len(ce1.l) > 2 {
+			t.Fatalf("Key %s has %d subs, expected at most 2", key, len(ce1.l))
+		}
+	}
+}
+
+/**
+ * Namespaces
+ */
+
+func TestCachePrefixStaysInNamespace(t *testing.T) {
+	c := newCache()
+	c.put("team"+namespaceSeparator+"foo", "sub", "value", "", 0, 0, nil)
+	c.put("team"+namespaceSeparator+"foo/bar", "sub", "value", "", 0, 0, nil)
+	c.put("test", "sub", "value", "", 0, 0, nil)
+	c.put("team/foo", "sub", "value", "", 0, 0, nil)
+
+	if m := c.getByKeyPrefix("te"); len(m) != 2 || m["test"] == nil || m["team/foo"] == nil {
+		t.Fatalf("Prefix without a namespace got %v, expected test and team/foo", m)
+	}
+	if keyCount, _ := c.countByKeyPrefix(""); keyCount != 2 {
+		t.Fatalf("Counted %d keys without a namespace, expected 2", keyCount)
+	}
+	if keyCount, _ := c.countByKeyPrefix("team" + namespaceSeparator); keyCount != 2 {
+		t.Fatalf("Counted %d keys in the namespace, expected 2", keyCount)
+	}
+	if removed := c.deleteSub("", "sub"); removed != 2 {
+		t.Fatalf("Removed %d subs without a namespace, expected 2", removed)
+	}
+	if len(c.get("team"+namespaceSeparator+"foo")) != 1 {
+		t.Fatalf("Deleting without a namespace removed a namespaced sub")
+	}
+}
+
+func TestPersistEntryKeepsNamespace(t *testing.T) {
+	c := newCache()
+	c.put("team"+namespaceSeparator+"foo", "sub", "value", "", 0, 0, nil)
+	c.put("team/foo", "sub", "value", "", 0, 0, nil)
+
+	entryList, _ := c.snapshot()
+	namespaces := make(map[string]string)
+	for _, pe := range entryList {
+		namespaces[pe.Key] = pe.Namespace
+	}
+	if len(namespaces) != 2 || namespaces["foo"] != "team" || namespaces["team/foo"] != "" {
+		t.Fatalf("Snapshot has keys and namespaces %v", namespaces)
+	}
+
+	restored := newCache()
+	restored.merge(entryList)
+	if len(restored.get("team"+namespaceSeparator+"foo")) != 1 || len(restored.get("team/foo")) != 1 {
+		t.Fatalf("Merge didn't restore both keys")
+	}
+}
+
+/**
+ * Weighted selection
+ */
+
+func TestPickWeightedLargeWeights(t *testing.T) {
+	itemList := []Entry{
+		{Sub: "a", Weight: math.MaxInt},
+		{Sub: "b", Weight: math.MaxInt},
+	}
+	for i := 0; i < 100; i++ {
+		if index := pickWeighted(itemList); index < 0 || index >= len(itemList) {
+			t.Fatalf("Picked index %d out of %d entries", index, len(itemList))
+		}
+	}
+}
+
+/**
+ * Concurrency, meant to be run with -race
+ */
+
+func TestCacheConcurrentPutGet(t *testing.T) {
+	c := newCache()
+
+	const goroutines = 16
+	const keys = 8
+	const puts = 200
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(2)
+
+		// Each writer owns one sub in every key
+		go func(g int) {
+			defer wg.Done()
+			sub := "sub" + strconv.Itoa(g)
+			for i := 0; i < puts; i++ {
+				key := "key" + strconv.Itoa(i%keys)
+				c.put(key, sub, strconv.Itoa(i), "", 0, 0, nil)
+			}
+		}(g)
+
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < puts; i++ {
+				key := "key" + strconv.Itoa((g+i)%keys)
+				for _, item := range c.get(key) {
+					if item.Sub == "" || item.Version == 0 {
+						t.Errorf("Inconsistent entry in %s: %+v", key, item)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for k := 0; k < keys; k++ {
+		key := "key" + strconv.Itoa(k)
+		itemList := c.get(key)
+		if len(itemList) != goroutines {
+			t.Fatalf("Key %s has %d subs, expected %d", key, len(itemList), goroutines)
+		}
+
+		// The last put of each writer to this key
+		last := puts - keys + k
+		for _, item := range itemList {
+			if item.Value != strconv.Itoa(last) {
+				t.Errorf("Key %s sub %s has value %s, expected %d", key, item.Sub, item.Value, last)
+			}
+			if item.Version != puts/keys {
+				t.Errorf("Key %s sub %s has version %d, expected %d", key, item.Sub, item.Version, puts/keys)
+			}
+		}
+	}
+}
+
+func TestCacheConcurrentPutDelete(t *testing.T) {
+	c := newCache()
+
+	const goroutines = 16
+	const puts = 200
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			sub := "sub" + strconv.Itoa(g)
+			for i := 0; i < puts; i++ {
+				c.put("key", sub, strconv.Itoa(i), "", 0, 0, nil)
+				c.get("key")
+				if i%2 == 0 {
+					c.delete("key", sub)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Every writer ends with a put
+	if itemList := c.get("key"); len(itemList) != goroutines {
+		t.Fatalf("Key has %d subs, expected %d", len(itemList), goroutines)
+	}
+}
+
+func TestIdempotencyConcurrentRetries(t *testing.T) {
+	ic := newIdempotencyCache()
+
+	const goroutines = 16
+
+	var applied atomic.Int32
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				entry, reserved := ic.reserve("key")
+				if reserved {
+					applied.Add(1)
+					ic.complete(entry, 200, "response")
+					return
+				}
+				<-entry.done
+				if entry.status != 0 {
+					if entry.status != 200 || entry.rs != "response" {
+						t.Errorf("Got %d %v, expected the first response", entry.status, entry.rs)
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if applied.Load() != 1 {
+		t.Fatalf("Applied %d times, expected once", applied.Load())
+	}
+}
+
+func TestIdempotencyReleaseAllowsRetry(t *testing.T) {
+	ic := newIdempotencyCache()
+
+	entry, reserved := ic.reserve("key")
+	if !reserved {
+		t.Fatalf("First reserve didn't reserve")
+	}
+	ic.release(entry)
+
+	if _, reserved = ic.reserve("key"); !reserved {
+		t.Fatalf("Reserve after release didn't reserve")
+	}
+}
+
+/**
+ * Benchmarks
+ */
+
+func BenchmarkPut(b *testing.B) {
+	c := newCache()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.put(fmt.Sprintf("key%d", i%100), fmt.Sprintf("sub%d", i%10), "value", "", 0, 0, nil)
+			i++
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	c := newCache()
+	for i := 0; i < 1000; i++ {
+		c.put(fmt.Sprintf("key%d", i%100), fmt.Sprintf("sub%d", i%10), "value", "", 0, 0, nil)
+	}
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.get(fmt.Sprintf("key%d", i%100))
+			i++
+		}
+	})
+}